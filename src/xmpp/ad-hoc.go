@@ -36,9 +36,9 @@ const (
 type AdHocCommand struct {
 	XMLName   xml.Name   `xml:"http://jabber.org/protocol/commands command"`
 	Node      string     `xml:"node,attr"`
-	Action    string     `xml:"action,attr"`
-	SessionID string     `xml:"sessionid,attr"`
-	Status    string     `xml:"status,attr"`
+	Action    string     `xml:"action,attr,omitempty"`
+	SessionID string     `xml:"sessionid,attr,omitempty"`
+	Status    string     `xml:"status,attr,omitempty"`
 	XForm     AdHocXForm `xml:"x"`
 	Note      AdHocNote  `xml:"note,omitempty"`
 }
@@ -46,15 +46,15 @@ type AdHocCommand struct {
 type AdHocXForm struct {
 	XMLName      xml.Name     `xml:"jabber:x:data x"`
 	Type         string       `xml:"type,attr"`
-	Title        string       `xml:"title"`
-	Instructions string       `xml:"instructions"`
+	Title        string       `xml:"title,omitempty"`
+	Instructions string       `xml:"instructions,omitempty"`
 	Fields       []AdHocField `xml:"field"`
 }
 
 type AdHocField struct {
 	Var     string             `xml:"var,attr"`
-	Label   string             `xml:"label,attr"`
-	Type    string             `xml:"type,attr"`
+	Label   string             `xml:"label,attr,omitempty"`
+	Type    string             `xml:"type,attr,omitempty"`
 	Options []AdHocFieldOption `xml:"option"`
 	Value   string             `xml:"value,omitempty"`
 }
@@ -0,0 +1,18 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const (
+	NSCaps = "http://jabber.org/protocol/caps"
+)
+
+// XEP-0115: Entity Capabilities
+
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
@@ -17,6 +17,12 @@ type ClientConfig struct {
 	// Skip verification of the server's certificate chain. Probably only
 	// useful during development.
 	InsecureSkipVerify bool
+
+	// Language of the stanzas sent, e.g. "en". It's declared by the stream
+	// header and added to outgoing stanzas that don't have one. The server
+	// may use a different language for the stanzas it sends (RFC 6120
+	// section 4.7.4), see Stream.RecvLang.
+	Lang string
 }
 
 // Create a client XMPP over the stream.
@@ -26,14 +32,15 @@ func NewClientXMPP(stream *Stream, jid JID, password string, config *ClientConfi
 		config = &ClientConfig{}
 	}
 
+	var f *features
 	for {
 
-		if err := startClient(stream, jid); err != nil {
+		if err := startClient(stream, jid, config.Lang); err != nil {
 			return nil, err
 		}
 
 		// Read features.
-		f := new(features)
+		f = new(features)
 		if err := stream.Decode(f, nil); err != nil {
 			return nil, err
 		}
@@ -77,13 +84,15 @@ func NewClientXMPP(stream *Stream, jid JID, password string, config *ClientConfi
 		break
 	}
 
-	return newXMPP(jid, stream), nil
+	x := newXMPP(jid, stream)
+	x.features = f
+	return x, nil
 }
 
-func startClient(stream *Stream, jid JID) error {
+func startClient(stream *Stream, jid JID, lang string) error {
 
 	start := xml.StartElement{
-		xml.Name{"stream", "stream"},
+		xml.Name{nsStreams, "stream"},
 		[]xml.Attr{
 			xml.Attr{xml.Name{"", "xmlns"}, nsClient},
 			xml.Attr{xml.Name{"xmlns", "stream"}, nsStreams},
@@ -92,6 +101,9 @@ func startClient(stream *Stream, jid JID) error {
 			xml.Attr{xml.Name{"", "version"}, "1.0"},
 		},
 	}
+	if lang != "" {
+		start.Attr = append(start.Attr, xml.Attr{xml.Name{nsXML, "lang"}, lang})
+	}
 
 	rstart, err := stream.SendStart(&start)
 	if err != nil {
@@ -205,8 +217,7 @@ func bindResource(stream *Stream, jid JID) (JID, error) {
 	bindResp := bindIQ{}
 	resp.PayloadDecode(&bindResp)
 
-	boundJID, err := ParseJID(bindResp.JID)
-	return boundJID, nil
+	return ParseJID(bindResp.JID)
 }
 
 type bindIQ struct {
@@ -243,11 +254,21 @@ func stringSliceContains(l []string, m string) bool {
 }
 
 type features struct {
-	XMLName    xml.Name     `xml:"http://etherx.jabber.org/streams features"`
-	StartTLS   *tlsStartTLS `xml:"starttls"`
-	Mechanisms *mechanisms  `xml:"mechanisms"`
-	Bind       *bind        `xml:"bind"`
-	Session    *session     `xml:"session"`
+	XMLName     xml.Name     `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS    *tlsStartTLS `xml:"starttls"`
+	Mechanisms  *mechanisms  `xml:"mechanisms"`
+	Bind        *bind        `xml:"bind"`
+	Session     *session     `xml:"session"`
+	RosterVer   *rosterVer   `xml:"ver"`
+	PreApproval *preApproval `xml:"sub"`
+}
+
+type rosterVer struct {
+	XMLName xml.Name `xml:"urn:xmpp:features:rosterver ver"`
+}
+
+type preApproval struct {
+	XMLName xml.Name `xml:"urn:xmpp:features:pre-approval sub"`
 }
 
 type session struct {
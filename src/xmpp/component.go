@@ -25,7 +25,7 @@ func NewComponentXMPP(stream *Stream, jid JID, secret string) (*XMPP, error) {
 func startComponent(stream *Stream, jid JID) (string, error) {
 
 	start := xml.StartElement{
-		xml.Name{"stream", "stream"},
+		xml.Name{nsStreams, "stream"},
 		[]xml.Attr{
 			xml.Attr{xml.Name{"", "xmlns"}, nsComponentAccept},
 			xml.Attr{xml.Name{"xmlns", "stream"}, nsStreams},
@@ -1,7 +1,9 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"strings"
 )
 
@@ -50,50 +52,56 @@ type DiscoItem struct {
 	Name string `xml:"name,attr"`
 }
 
-// Request information about the service identified by 'to'.
+// Request information about the service identified by 'to'. An error
+// response is returned as its *Error.
 func (disco *Disco) Info(to, from string) (*DiscoInfo, error) {
-
-	if from == "" {
-		from = disco.XMPP.JID.Full()
+	info, err := disco.InfoContext(context.Background(), to, from, "")
+	if err != nil {
+		return nil, responseError(err)
 	}
+	return info, nil
+}
 
-	req := &IQ{ID: UUID4(), Type: IQTypeGet, To: to, From: from}
-	req.PayloadEncode(&DiscoInfo{})
+// Request information about the node of the service identified by 'to',
+// waiting until the context is done at most. Unlike Info, an error response
+// is returned as an *IQError.
+func (disco *Disco) InfoContext(ctx context.Context, to, from, node string) (*DiscoInfo, error) {
+	return Request[DiscoInfo](ctx, disco.XMPP, disco.request(to, from), &DiscoInfo{Node: node})
+}
 
-	resp, err := disco.XMPP.SendRecv(req)
+// Request items in the service identified by 'to'. An error response is
+// returned as its *Error.
+func (disco *Disco) Items(to, from, node string) (*DiscoItems, error) {
+	items, err := disco.ItemsContext(context.Background(), to, from, node)
 	if err != nil {
-		return nil, err
-	} else if resp.Error != nil {
-		return nil, resp.Error
+		return nil, responseError(err)
 	}
+	return items, nil
+}
 
-	info := &DiscoInfo{}
-	resp.PayloadDecode(info)
-
-	return info, err
+// Request items in the service identified by 'to', waiting until the context
+// is done at most. Unlike Items, an error response is returned as an
+// *IQError.
+func (disco *Disco) ItemsContext(ctx context.Context, to, from, node string) (*DiscoItems, error) {
+	return Request[DiscoItems](ctx, disco.XMPP, disco.request(to, from), &DiscoItems{Node: node})
 }
 
-// Request items in the service identified by 'to'.
-func (disco *Disco) Items(to, from, node string) (*DiscoItems, error) {
+// Return the *Error of an *IQError, as returned for an error response before
+// the Context variants existed, or err itself.
+func responseError(err error) error {
+	var iqErr *IQError
+	if errors.As(err, &iqErr) {
+		return iqErr.Err
+	}
+	return err
+}
 
+// Create a get request, from the XMPP instance's JID if from is empty.
+func (disco *Disco) request(to, from string) *IQ {
 	if from == "" {
 		from = disco.XMPP.JID.Full()
 	}
-
-	req := &IQ{ID: UUID4(), Type: IQTypeGet, To: to, From: from}
-	req.PayloadEncode(&DiscoItems{Node: node})
-
-	resp, err := disco.XMPP.SendRecv(req)
-	if err != nil {
-		return nil, err
-	} else if resp.Error != nil {
-		return nil, resp.Error
-	}
-
-	items := &DiscoItems{}
-	resp.PayloadDecode(items)
-
-	return items, err
+	return &IQ{Type: IQTypeGet, To: to, From: from}
 }
 
 var discoNamespacePrefix = strings.Split(NSDiscoInfo, "#")[0]
@@ -27,6 +27,15 @@ connected:
 
 	X.Out <- xmpp.Presence{}
 
+Errors writing to the Out channel are only logged. Use Send to wait for a
+stanza to be written and find out if it failed:
+
+	err := X.Send(ctx, xmpp.Presence{})
+
+Close ends the conversation cleanly, waiting for the server to close its end
+of the stream. The Done channel is closed once the conversation is over,
+however it ended.
+
 Incoming messages are handled by consuming the XMPP instance's In channel.  The
 channel is sent all XMPP stanzas as well as terminating error (io.EOF for clean
 shutdown or any other error for something unexpected). The channel is also
@@ -47,6 +56,35 @@ respectively.
 		}
 	}
 
+Children of a <message/> or <presence/> that the structs don't otherwise
+decode are kept in their Extensions field, so stanzas can be forwarded intact.
+IQ payloads and extensions whose element names are registered, including all
+the payloads defined by this package, can be decoded without knowing their
+type up front:
+
+	v, err := iq.Decoded()     // e.g. *xmpp.DiscoInfo
+	exts, err := msg.Decoded() // e.g. *xmpp.Composing
+	xmpp.Register(&MyExtension{})
+
+Instead of consuming the In channel directly, stanzas can be routed to
+handlers. An IQMux routes <iq/> requests by type and payload, and answers any
+request without a handler with an error. A StanzaMux routes messages and
+presences using Matchers, e.g. a Route, and supports middleware:
+
+	iqs := xmpp.NewIQMux()
+	iqs.HandleFunc(xmpp.IQTypeGet, xml.Name{xmpp.NSPing, "ping"}, func(x *xmpp.XMPP, iq *xmpp.IQ) {
+		x.Send(context.Background(), iq.Response(xmpp.IQTypeResult))
+	})
+	stop := iqs.Serve(X)
+	defer stop()
+
+	stanzas := xmpp.NewStanzaMux()
+	stanzas.HandleFunc(xmpp.Route{Kind: "message", Type: xmpp.MessageTypeChat}, func(x *xmpp.XMPP, v interface{}) {
+		log.Printf("chat : %v\n", v)
+	})
+	stopStanzas := stanzas.Serve(X, nil)
+	defer stopStanzas()
+
 Note: A "bound" JID is negotatiated during XMPP setup and may be different to
 the JID passed to the New(Client|Component)XMPP() call. Always use the XMPP
 instance's JID attribute in any stanzas.
@@ -0,0 +1,136 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+// Child element of a stanza that the stanza's type doesn't otherwise decode,
+// e.g. a delivery receipt, delayed delivery or MUC element, or a custom
+// application payload. Unknown children are kept so stanzas can be forwarded
+// or re-encoded intact.
+//
+// The element's content is kept as a list of StartElement, EndElement and
+// CharData tokens. Names are resolved to their namespace, so namespace
+// declarations are not kept; they are added back as needed when the extension
+// is encoded.
+type Extension struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr
+	Tokens  []xml.Token
+}
+
+// Implement xml.Unmarshaler.
+func (e *Extension) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	e.XMLName = start.Name
+	e.Attrs = stripNamespaceDecls(start.Attr)
+	e.Tokens = nil
+	for depth := 0; ; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			t.Attr = stripNamespaceDecls(t.Attr)
+			e.Tokens = append(e.Tokens, t)
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+			e.Tokens = append(e.Tokens, t)
+		case xml.CharData:
+			e.Tokens = append(e.Tokens, t.Copy())
+		}
+	}
+}
+
+// Implement xml.Marshaler.
+func (e *Extension) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: e.XMLName, Attr: e.Attrs}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, tok := range e.Tokens {
+		if err := enc.EncodeToken(tok); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// Decode the extension into the given value. See xml.Unmarshal for how the
+// value is decoded.
+func (e *Extension) Decode(v interface{}) error {
+	b, err := xml.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(b, v)
+}
+
+// Return a copy of the attributes without the namespace declarations.
+func stripNamespaceDecls(attrs []xml.Attr) []xml.Attr {
+	var stripped []xml.Attr
+	for _, attr := range attrs {
+		if attr.Name.Space == "xmlns" || attr.Name == (xml.Name{Local: "xmlns"}) {
+			continue
+		}
+		stripped = append(stripped, attr)
+	}
+	return stripped
+}
+
+// Stanza extensions, in the order they appeared in the stanza.
+type Extensions []Extension
+
+// Return the first extension in the namespace, or nil if there is none.
+func (exts Extensions) Find(space string) *Extension {
+	for i := range exts {
+		if exts[i].XMLName.Space == space {
+			return &exts[i]
+		}
+	}
+	return nil
+}
+
+// Decode the first extension in the namespace into the given value. Returns
+// false if there is no extension in the namespace.
+func (exts Extensions) Get(space string, v interface{}) (bool, error) {
+	e := exts.Find(space)
+	if e == nil {
+		return false, nil
+	}
+	return true, e.Decode(v)
+}
+
+// Encode the value and add it as an extension, replacing any existing
+// extensions with the same element name. See xml.Marshal for how the value is
+// encoded.
+func (exts *Extensions) Set(v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var e Extension
+	if err := xml.Unmarshal(b, &e); err != nil {
+		return err
+	}
+	exts.Remove(e.XMLName)
+	*exts = append(*exts, e)
+	return nil
+}
+
+// Remove the extensions with the element name. A name with an empty Local
+// removes all the extensions in the namespace.
+func (exts *Extensions) Remove(name xml.Name) {
+	kept := (*exts)[:0]
+	for _, e := range *exts {
+		if e.XMLName.Space == name.Space && (name.Local == "" || e.XMLName.Local == name.Local) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	*exts = kept
+}
@@ -0,0 +1,72 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+type testReceipt struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+	ID      string   `xml:"id,attr"`
+}
+
+func TestMessageExtensions(t *testing.T) {
+	in := "<message xmlns='jabber:client' to='a@b' type='chat'>" +
+		"<body>Hi</body>" +
+		"<request xmlns='urn:xmpp:receipts'/>" +
+		"<x xmlns='jabber:x:oob' xmlns:o='urn:other' o:attr='1'><url>http://example.com/?a=1&amp;b=2</url><o:desc>Example</o:desc></x>" +
+		"<delay xmlns='urn:xmpp:delay' stamp='2002-09-10T23:08:25Z'/>" +
+		"</message>"
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(in), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body[0].Value != "Hi" || len(msg.Extensions) != 3 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// Re-encoding the message must keep the extensions intact.
+	out, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2 := &Message{}
+	if err := xml.Unmarshal(out, msg2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Extensions, msg2.Extensions) {
+		t.Errorf("extensions not preserved:\n%s\n%s", in, out)
+	}
+
+	oob := struct {
+		URL  string `xml:"url"`
+		Desc string `xml:"urn:other desc"`
+	}{}
+	if ok, err := msg2.Extensions.Get("jabber:x:oob", &oob); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if oob.URL != "http://example.com/?a=1&b=2" || oob.Desc != "Example" {
+		t.Errorf("unexpected oob: %+v", oob)
+	}
+	if ok, _ := msg2.Extensions.Get("urn:unknown", &oob); ok {
+		t.Error("unexpected extension")
+	}
+}
+
+func TestSetExtension(t *testing.T) {
+	presence := &Presence{}
+	presence.Extensions.Set(&testReceipt{ID: "1"})
+	presence.Extensions.Set(&testReceipt{ID: "2"})
+	if len(presence.Extensions) != 1 {
+		t.Fatalf("expected 1 extension, got %d", len(presence.Extensions))
+	}
+	receipt := &testReceipt{}
+	if ok, err := presence.Extensions.Get("urn:xmpp:receipts", receipt); !ok || err != nil || receipt.ID != "2" {
+		t.Errorf("unexpected receipt: %v %v %+v", ok, err, receipt)
+	}
+	presence.Extensions.Remove(xml.Name{Space: "urn:xmpp:receipts"})
+	if len(presence.Extensions) != 0 {
+		t.Errorf("expected no extensions, got %d", len(presence.Extensions))
+	}
+}
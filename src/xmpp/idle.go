@@ -0,0 +1,17 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const (
+	NSIdle = "urn:xmpp:idle:1"
+)
+
+// XEP-0319: Last User Interaction in Presence
+
+type Idle struct {
+	XMLName xml.Name  `xml:"urn:xmpp:idle:1 idle"`
+	Since   time.Time `xml:"since,attr"`
+}
@@ -0,0 +1,278 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Maximum length of a DNS label, in octets, in its ASCII (A-label) form.
+const maxLabelLength = 63
+
+// Prefix of an A-label, an internationalised label encoded as ASCII.
+const acePrefix = "xn--"
+
+// Prepare a JID's domainpart, as described by RFC 7622 section 3.2. Labels
+// are converted to their Unicode form (U-labels) and lowercased, full stops
+// are mapped to '.' and a trailing '.' is removed. IP literals are accepted
+// as they are.
+func prepareDomain(s string) (string, error) {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		ip := net.ParseIP(s[1 : len(s)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", errors.New("invalid IPv6 address")
+		}
+		return s, nil
+	}
+
+	s = strings.Map(mapDomainRune, s)
+	s = strings.TrimSuffix(s, ".")
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	labels := strings.Split(s, ".")
+	for i, label := range labels {
+		label, err := prepareLabel(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = label
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// Map full stops and full-width ASCII, and lowercase.
+func mapDomainRune(r rune) rune {
+	switch r {
+	case '。', '．', '｡':
+		return '.'
+	}
+	return unicode.ToLower(mapWidth(r))
+}
+
+// Validate a lowercased label and return its U-label form.
+func prepareLabel(label string) (string, error) {
+	if label == "" {
+		return "", errors.New("empty label")
+	}
+
+	// Decode an A-label, which must be the encoding of a valid U-label.
+	if strings.HasPrefix(label, acePrefix) {
+		decoded, err := punycodeDecode(label[len(acePrefix):])
+		if err != nil {
+			return "", err
+		}
+		if isASCII(decoded) {
+			return "", errors.New("invalid A-label " + label)
+		}
+		label = decoded
+	}
+
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return "", errors.New("label starts or ends with a hyphen")
+	}
+	if isASCII(label) {
+		// Underscores aren't valid in host names but are found in deployed
+		// domains, e.g. of components, so accept them in received addresses.
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return "", fmt.Errorf("label contains %q", r)
+			}
+		}
+		if len(label) > maxLabelLength {
+			return "", errors.New("label too long")
+		}
+		return label, nil
+	}
+
+	// Approximates the IDNA2008 PVALID code points using the Unicode
+	// categories.
+	if len(label) >= 4 && label[2:4] == "--" {
+		return "", errors.New("label has hyphens in the third and fourth positions")
+	}
+	for i, r := range label {
+		if i == 0 && unicode.In(r, unicode.Mn, unicode.Mc, unicode.Me) {
+			return "", errors.New("label starts with a combining mark")
+		}
+		if r == '-' || unicode.In(r, unicode.Ll, unicode.Lo, unicode.Lm, unicode.Nd, unicode.Mn, unicode.Mc) {
+			continue
+		}
+		return "", fmt.Errorf("label contains %q", r)
+	}
+	if len(acePrefix)+len(punycodeEncode(label)) > maxLabelLength {
+		return "", errors.New("label too long")
+	}
+	return label, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode (RFC 3492) parameters.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycode = errors.New("invalid punycode")
+
+// Encode a Unicode string as punycode, without the ACE prefix.
+func punycodeEncode(s string) string {
+	runes := []rune(s)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		m := rune(unicode.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+// Decode punycode, without the ACE prefix, to a Unicode string.
+func punycodeDecode(s string) (string, error) {
+	var output []rune
+	if i := strings.LastIndex(s, "-"); i != -1 {
+		for _, r := range s[:i] {
+			if r >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			output = append(output, r)
+		}
+		s = s[i+1:]
+	}
+
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for pos := 0; pos < len(s); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos == len(s) {
+				return "", errPunycode
+			}
+			digit, ok := punyValue(s[pos])
+			pos++
+			if !ok || digit > (maxPunyInt-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > maxPunyInt/(punyBase-t) {
+				return "", errPunycode
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += rune(i / (len(output) + 1))
+		if n > unicode.MaxRune || n < punyInitialN {
+			return "", errPunycode
+		}
+		i %= len(output) + 1
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
+
+const maxPunyInt = 1<<31 - 1
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
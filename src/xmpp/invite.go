@@ -0,0 +1,171 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	NSPreauth = "urn:xmpp:pars:0"
+
+	NodeInvite              = "urn:xmpp:invite#invite"
+	NodeInviteCreateAccount = "urn:xmpp:invite#create-account"
+)
+
+// XEP-0379: Pre-Authenticated Roster Subscription
+
+// Token sent with a subscription request to prove the contact was invited,
+// so the request can be approved automatically.
+type Preauth struct {
+	XMLName xml.Name `xml:"urn:xmpp:pars:0 preauth"`
+	Token   string   `xml:"token,attr"`
+}
+
+// Generate a new, random preauth token.
+func NewPreauthToken() string {
+	return SessionID()
+}
+
+// Create an invite URI for the JID carrying the token, e.g.
+// xmpp:romeo@montague.lit?roster;preauth=TOKEN. The action is typically
+// URIActionRoster, to subscribe to the JID, or URIActionRegister, to register
+// an account on the JID's server.
+func PreauthURI(jid JID, action URIAction, token string) *URI {
+	u := &URI{JID: jid, Action: action}
+	u.AddParam("preauth", token)
+	return u
+}
+
+// Create a subscription request to the JID that carries the preauth token.
+func PreauthSubscribe(to JID, token string) *Presence {
+	presence := &Presence{To: to.Bare(), Type: PresenceTypeSubscribe}
+	presence.Extensions.Set(&Preauth{Token: token})
+	return presence
+}
+
+// Return the preauth token of a subscription request, or false if there is
+// none.
+func PreauthToken(presence *Presence) (string, bool) {
+	preauth := &Preauth{}
+	if ok, err := presence.Extensions.Get(NSPreauth, preauth); !ok || err != nil || preauth.Token == "" {
+		return "", false
+	}
+	return preauth.Token, true
+}
+
+// XEP-0401: Ad-hoc Account Invitation Generation
+
+// Invitation created by the server.
+type Invite struct {
+	// URI to give to the invitee, including the preauth token.
+	URI *URI
+
+	// Web page that helps the invitee use the URI. Optional.
+	LandingURL string
+
+	// When the invitation expires. Zero if the server didn't say.
+	Expire time.Time
+}
+
+// Return the invite's preauth token.
+func (invite *Invite) Token() string {
+	token, _ := invite.URI.Param("preauth")
+	return token
+}
+
+// Pre-authenticated invitations protocol. "Wraps" XMPP instance to provide a
+// convenient API for creating and accepting invitations.
+type Invites struct {
+	XMPP *XMPP
+}
+
+// Ask the server to create an invitation for a contact. Anyone using the
+// invitation is automatically subscribed to and from the account.
+func (invites *Invites) Create(ctx context.Context, server string) (*Invite, error) {
+	return invites.execute(ctx, server, NodeInvite, nil)
+}
+
+// Ask the server to create an invitation to register an account. The
+// username is a suggestion and may be empty. If rosterSubscription is true
+// the new account is subscribed to and from this account.
+func (invites *Invites) CreateAccount(ctx context.Context, server, username string, rosterSubscription bool) (*Invite, error) {
+	fields := []AdHocField{
+		{Var: "roster-subscription", Value: "false"},
+	}
+	if rosterSubscription {
+		fields[0].Value = "true"
+	}
+	if username != "" {
+		fields = append(fields, AdHocField{Var: "username", Value: username})
+	}
+	return invites.execute(ctx, server, NodeInviteCreateAccount, fields)
+}
+
+// Execute the invite command, submitting the fields if the server asks for
+// a form, and return the invite from the command's result.
+func (invites *Invites) execute(ctx context.Context, server, node string, fields []AdHocField) (*Invite, error) {
+	cmd, err := Set[AdHocCommand](ctx, invites.XMPP, server, &inviteCommand{Node: node, Action: ActionAdHocExecute})
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.Status == StatusAdHocExecute {
+		submit := &inviteCommand{
+			Node:      node,
+			SessionID: cmd.SessionID,
+			XForm:     &AdHocXForm{Type: TypeAdHocSubmit, Fields: fields},
+		}
+		if cmd, err = Set[AdHocCommand](ctx, invites.XMPP, server, submit); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Status != StatusAdHocCompleted {
+		return nil, errors.New("invite command not completed: " + cmd.Status)
+	}
+
+	invite := &Invite{}
+	for _, field := range cmd.XForm.Fields {
+		switch field.Var {
+		case "uri":
+			if invite.URI, err = ParseURI(field.Value); err != nil {
+				return nil, err
+			}
+		case "landing-url":
+			invite.LandingURL = field.Value
+		case "expire":
+			if invite.Expire, err = time.Parse(time.RFC3339, field.Value); err != nil {
+				return nil, fmt.Errorf("invite command result has an invalid expire: %w", err)
+			}
+		}
+	}
+	if invite.URI == nil {
+		return nil, errors.New("invite command result has no uri")
+	}
+	return invite, nil
+}
+
+// Ad-hoc command request. Unlike AdHocCommand, the form is optional.
+type inviteCommand struct {
+	XMLName   xml.Name    `xml:"http://jabber.org/protocol/commands command"`
+	Node      string      `xml:"node,attr"`
+	Action    string      `xml:"action,attr,omitempty"`
+	SessionID string      `xml:"sessionid,attr,omitempty"`
+	XForm     *AdHocXForm `xml:"x"`
+}
+
+// Accept an invitation to subscribe to a contact, i.e. a URI with the roster
+// or subscribe action, by sending a subscription request carrying the URI's
+// preauth token, if any.
+func (invites *Invites) Accept(ctx context.Context, u *URI) error {
+	if u.Action != URIActionRoster && u.Action != URIActionSubscribe {
+		return errors.New("not a roster invitation: " + u.String())
+	}
+	token, ok := u.Param("preauth")
+	if !ok {
+		return invites.XMPP.Send(ctx, &Presence{To: u.JID.Bare(), Type: PresenceTypeSubscribe})
+	}
+	return invites.XMPP.Send(ctx, PreauthSubscribe(u.JID, token))
+}
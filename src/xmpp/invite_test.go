@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestCreateAccountInvite(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		cmd := &AdHocCommand{}
+		req.PayloadDecode(cmd)
+		if req.Type != IQTypeSet || cmd.Node != NodeInviteCreateAccount || cmd.Action != ActionAdHocExecute {
+			t.Errorf("unexpected request: %v", req)
+		}
+		s.send(t, "<iq type='result' from='wonderland.lit' id='"+req.ID+"'>"+
+			"<command xmlns='http://jabber.org/protocol/commands' node='urn:xmpp:invite#create-account' sessionid='s1' status='executing'>"+
+			"<x xmlns='jabber:x:data' type='form'><field var='username' type='text-single'/><field var='roster-subscription' type='boolean'/></x>"+
+			"</command></iq>")
+
+		req = s.recvIQ(t)
+		cmd = &AdHocCommand{}
+		req.PayloadDecode(cmd)
+		if cmd.SessionID != "s1" || cmd.XForm.Type != TypeAdHocSubmit || len(cmd.XForm.Fields) != 2 {
+			t.Errorf("unexpected submit: %v", req)
+		}
+		s.send(t, "<iq type='result' from='wonderland.lit' id='"+req.ID+"'>"+
+			"<command xmlns='http://jabber.org/protocol/commands' node='urn:xmpp:invite#create-account' sessionid='s1' status='completed'>"+
+			"<x xmlns='jabber:x:data' type='result'>"+
+			"<field var='uri'><value>xmpp:wonderland.lit?register;preauth=TOKEN</value></field>"+
+			"<field var='landing-url'><value>https://wonderland.lit/invite/TOKEN</value></field>"+
+			"<field var='expire'><value>2026-10-20T12:00:00Z</value></field>"+
+			"</x></command></iq>")
+	}()
+
+	invites := &Invites{x}
+	invite, err := invites.CreateAccount(context.Background(), "wonderland.lit", "hatter", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite.Token() != "TOKEN" || invite.URI.Action != URIActionRegister || invite.URI.JID.Domain != "wonderland.lit" {
+		t.Errorf("unexpected uri: %v", invite.URI)
+	}
+	if invite.LandingURL != "https://wonderland.lit/invite/TOKEN" || !invite.Expire.Equal(time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected invite: %+v", invite)
+	}
+}
+
+func TestInviteInvalidExpire(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='result' from='wonderland.lit' id='"+req.ID+"'>"+
+			"<command xmlns='http://jabber.org/protocol/commands' node='urn:xmpp:invite#invite' status='completed'>"+
+			"<x xmlns='jabber:x:data' type='result'>"+
+			"<field var='uri'><value>xmpp:alice@wonderland.lit?roster;preauth=TOKEN</value></field>"+
+			"<field var='expire'><value>tomorrow</value></field>"+
+			"</x></command></iq>")
+	}()
+	if invite, err := (&Invites{x}).Create(context.Background(), "wonderland.lit"); err == nil {
+		t.Errorf("expected error, got %+v", invite)
+	}
+}
+
+func TestAcceptInvite(t *testing.T) {
+	x, s := newTestXMPP(t)
+	token := NewPreauthToken()
+	u := PreauthURI(MustParseJID("hatter@wonderland.lit"), URIActionRoster, token)
+	if u.String() != "xmpp:hatter@wonderland.lit?roster;preauth="+token {
+		t.Errorf("unexpected uri: %s", u)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- (&Invites{x}).Accept(context.Background(), u)
+	}()
+	presence := &Presence{}
+	if err := s.dec.Decode(presence); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if presence.Type != "subscribe" || presence.To != "hatter@wonderland.lit" {
+		t.Errorf("unexpected presence: %+v", presence)
+	}
+	if received, ok := PreauthToken(presence); !ok || received != token {
+		t.Errorf("expected token %q, got %q", token, received)
+	}
+
+	b, _ := xml.Marshal(PreauthSubscribe(MustParseJID("hatter@wonderland.lit/tea"), "T"))
+	if string(b) != `<presence type="subscribe" to="hatter@wonderland.lit"><preauth xmlns="urn:xmpp:pars:0" token="T"></preauth></presence>` {
+		t.Errorf("unexpected presence: %s", b)
+	}
+}
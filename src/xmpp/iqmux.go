@@ -0,0 +1,137 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"sync"
+)
+
+// Handles an <iq type="get|set"/> request. The handler is responsible for
+// sending a reply, typically one created by the request's Response method.
+type IQHandler interface {
+	HandleIQ(x *XMPP, iq *IQ)
+}
+
+// Adapter to allow a plain func to be used as an IQHandler.
+type IQHandlerFunc func(x *XMPP, iq *IQ)
+
+// Implement IQHandler by calling the adapted func.
+func (fn IQHandlerFunc) HandleIQ(x *XMPP, iq *IQ) {
+	fn(x, iq)
+}
+
+// IQ request multiplexer. Routes incoming <iq type="get|set"/> requests to the
+// handler registered for the request's type and payload name.
+//
+// Requests without a registered handler are answered automatically, as
+// required by RFC 6120. If nothing is registered for the payload's namespace
+// the reply is a service-unavailable error, otherwise it's a
+// feature-not-implemented error.
+type IQMux struct {
+	lock     sync.RWMutex
+	handlers map[iqRoute]IQHandler
+	spaces   map[string]int
+}
+
+type iqRoute struct {
+	Type string
+	Name xml.Name
+}
+
+// Create a new, empty IQMux.
+func NewIQMux() *IQMux {
+	return &IQMux{
+		handlers: make(map[iqRoute]IQHandler),
+		spaces:   make(map[string]int),
+	}
+}
+
+// Register the handler for requests of the given type, IQTypeGet or
+// IQTypeSet, with a payload of the given name. A name with an empty Local
+// registers the handler for any payload in the namespace. Registering a
+// handler for a route that's already registered replaces it.
+func (mux *IQMux) Handle(iqType string, name xml.Name, h IQHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	route := iqRoute{iqType, name}
+	if _, ok := mux.handlers[route]; !ok {
+		mux.spaces[name.Space]++
+	}
+	mux.handlers[route] = h
+}
+
+// Register the handler func for requests of the given type with a payload of
+// the given name. See Handle.
+func (mux *IQMux) HandleFunc(iqType string, name xml.Name, fn func(x *XMPP, iq *IQ)) {
+	mux.Handle(iqType, name, IQHandlerFunc(fn))
+}
+
+// Return the handler for the request, or nil if there is no handler.
+func (mux *IQMux) Handler(iq *IQ) IQHandler {
+	name := iq.PayloadName()
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+	if h, ok := mux.handlers[iqRoute{iq.Type, name}]; ok {
+		return h
+	}
+	return mux.handlers[iqRoute{iq.Type, xml.Name{Space: name.Space}}]
+}
+
+// Dispatch the request to its handler, or reply with an error if there is no
+// handler. Implements IQHandler so muxes can be nested.
+func (mux *IQMux) HandleIQ(x *XMPP, iq *IQ) {
+	if iq.Type != IQTypeGet && iq.Type != IQTypeSet {
+		return
+	}
+	if h := mux.Handler(iq); h != nil {
+		h.HandleIQ(x, iq)
+		return
+	}
+	if err := x.Send(context.Background(), mux.unhandled(iq)); err != nil && err != ErrStreamClosed {
+		log.Println("Error. Failed to send IQ error. ", err)
+	}
+}
+
+// Build the error reply for a request that has no handler.
+func (mux *IQMux) unhandled(iq *IQ) *IQ {
+	name := iq.PayloadName()
+	mux.lock.RLock()
+	known := mux.spaces[name.Space] > 0
+	mux.lock.RUnlock()
+
+	condition := ErrorServiceUnavailable
+	switch {
+	case name.Local == "":
+		condition = ErrorBadRequest
+	case known:
+		condition = ErrorFeatureNotImplemented
+	}
+	return iq.ErrorResponse(condition, "")
+}
+
+// Start routing requests received by x to the registered handlers, until the
+// stream closes or the returned stop func is called. Each request is handled
+// in its own goroutine.
+func (mux *IQMux) Serve(x *XMPP) (stop func() error) {
+	fid, ch := x.AddFilter(IQRequest)
+	go func() {
+		for v := range ch {
+			go mux.HandleIQ(x, v.(*IQ))
+		}
+	}()
+	return func() error {
+		return x.RemoveFilter(fid)
+	}
+}
+
+// Matcher to identify <iq type="get|set"/> requests.
+var IQRequest = MatcherFunc(
+	func(v interface{}) bool {
+		iq, ok := v.(*IQ)
+		if !ok {
+			return false
+		}
+		return iq.Type == IQTypeGet || iq.Type == IQTypeSet
+	},
+)
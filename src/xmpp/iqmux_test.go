@@ -0,0 +1,55 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestIQMux(t *testing.T) {
+	x, s := newTestXMPP(t)
+
+	mux := NewIQMux()
+	mux.HandleFunc(IQTypeGet, xml.Name{NSPing, "ping"}, func(x *XMPP, iq *IQ) {
+		x.Send(context.Background(), iq.Response(IQTypeResult))
+	})
+	stop := mux.Serve(x)
+
+	tests := []struct {
+		request   string
+		condition string
+	}{
+		{"<iq type='get' id='1'><ping xmlns='urn:xmpp:ping'/></iq>", ""},
+		{"<iq type='set' id='2'><ping xmlns='urn:xmpp:ping'/></iq>", "feature-not-implemented"},
+		{"<iq type='get' id='3'><query xmlns='jabber:iq:version'/></iq>", "service-unavailable"},
+		{"<iq type='get' id='4'></iq>", "bad-request"},
+	}
+	for _, test := range tests {
+		go s.send(t, test.request)
+		resp := s.recvIQ(t)
+		if test.condition == "" {
+			if resp.Type != IQTypeResult {
+				t.Errorf("%s: expected result, got %v", test.request, resp)
+			}
+			continue
+		}
+		if resp.Type != IQTypeError || resp.Error == nil || resp.Error.Condition().Local != test.condition {
+			t.Errorf("%s: expected %s, got %v", test.request, test.condition, resp)
+		}
+	}
+
+	// Requests are left for the In channel once the mux is stopped.
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	go s.send(t, "<iq type='get' id='5'><ping xmlns='urn:xmpp:ping'/></iq>")
+	select {
+	case v := <-x.In:
+		if iq, ok := v.(*IQ); !ok || iq.ID != "5" {
+			t.Errorf("unexpected stanza: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not delivered to In")
+	}
+}
@@ -1,6 +1,8 @@
 package xmpp
 
 import (
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -34,7 +36,7 @@ func (jid JID) Full() string {
 	if jid.Resource == "" {
 		return jid.Bare()
 	}
-	return fmt.Sprintf("%s@%s/%s", jid.Node, jid.Domain, jid.Resource)
+	return fmt.Sprintf("%s/%s", jid.Bare(), jid.Resource)
 }
 
 // Return full JID as a string.
@@ -42,24 +44,211 @@ func (jid JID) String() string {
 	return jid.Full()
 }
 
-// Parse a string into a JID structure.
+// Return true if the JIDs are the same address, after normalisation.
+func (jid JID) Equal(other JID) bool {
+	return jid.normalise() == other.normalise()
+}
+
+// Return true if the JIDs' bare JIDs are the same address, after
+// normalisation.
+func (jid JID) BareEqual(other JID) bool {
+	a, b := jid.normalise(), other.normalise()
+	return a.Node == b.Node && a.Domain == b.Domain
+}
+
+// Return the JID with its parts prepared for comparison. Parts that are not
+// valid are left as they are.
+func (jid JID) normalise() JID {
+	if node, err := prepareLocalpart(jid.Node); err == nil {
+		jid.Node = node
+	}
+	if domain, err := prepareDomain(jid.Domain); err == nil {
+		jid.Domain = domain
+	}
+	if resource, err := prepareResourcepart(jid.Resource); err == nil {
+		jid.Resource = resource
+	}
+	return jid
+}
+
+// Maximum length, in bytes, of each part of a JID.
+const maxJIDPartLength = 1023
+
+// Returned, wrapped with a description of the problem, by ParseJID for a
+// string that's not a valid JID.
+var ErrInvalidJID = errors.New("invalid JID")
+
+// Parse a string into a JID structure, as described by RFC 7622. The parts
+// are validated and normalised, e.g. the localpart and domainpart are
+// lowercased, so JIDs for the same address compare equal.
 func ParseJID(s string) (jid JID, err error) {
 
-	if parts := strings.SplitN(s, "/", 2); len(parts) == 1 {
-		s = parts[0]
-	} else {
-		s = parts[0]
-		jid.Resource = parts[1]
+	local, domain, resource := "", s, ""
+	hasLocal, hasResource := false, false
+	if i := strings.Index(domain, "/"); i != -1 {
+		domain, resource, hasResource = domain[:i], domain[i+1:], true
+	}
+	if i := strings.Index(domain, "@"); i != -1 {
+		local, domain, hasLocal = domain[:i], domain[i+1:], true
+	}
+
+	if hasLocal {
+		if jid.Node, err = prepareLocalpart(local); err != nil {
+			return JID{}, jidError(s, "localpart", err)
+		}
+		if len(jid.Node) > maxJIDPartLength {
+			return JID{}, jidError(s, "localpart", errors.New("too long"))
+		}
+	}
+	if jid.Domain, err = prepareDomain(domain); err != nil {
+		return JID{}, jidError(s, "domainpart", err)
+	}
+	if len(jid.Domain) > maxJIDPartLength {
+		return JID{}, jidError(s, "domainpart", errors.New("too long"))
+	}
+	if hasResource {
+		if jid.Resource, err = prepareResourcepart(resource); err != nil {
+			return JID{}, jidError(s, "resourcepart", err)
+		}
+		if len(jid.Resource) > maxJIDPartLength {
+			return JID{}, jidError(s, "resourcepart", errors.New("too long"))
+		}
 	}
 
-	if parts := strings.SplitN(s, "@", 2); len(parts) != 2 {
-		jid.Domain = parts[0]
-	} else {
-		jid.Node = parts[0]
-		jid.Domain = parts[1]
+	return jid, nil
+}
+
+func jidError(s, part string, err error) error {
+	return fmt.Errorf("%w %q: %s %v", ErrInvalidJID, s, part, err)
+}
+
+// Parse a string into a JID structure, panicking if it's not a valid JID.
+// Intended for JIDs known to be valid, e.g. constants.
+func MustParseJID(s string) JID {
+	jid, err := ParseJID(s)
+	if err != nil {
+		panic(err)
 	}
+	return jid
+}
+
+// XEP-0106: JID Escaping
 
-	return
+// Characters that are not allowed in a localpart and their escape sequences.
+// The backslash is only escaped when it would otherwise be read as the start
+// of an escape sequence.
+var jidEscapes = map[byte]string{
+	' ':  `\20`,
+	'"':  `\22`,
+	'&':  `\26`,
+	'\'': `\27`,
+	'/':  `\2f`,
+	':':  `\3a`,
+	'<':  `\3c`,
+	'>':  `\3e`,
+	'@':  `\40`,
+	'\\': `\5c`,
 }
 
-// BUG(matt): ParseJID should fail for incorrectly formatted JIDs.
+// Return the character escaped by the escape sequence at the start of s.
+func jidUnescape(s string) (byte, bool) {
+	if len(s) < 3 || s[0] != '\\' {
+		return 0, false
+	}
+	for c, seq := range jidEscapes {
+		if strings.EqualFold(s[:3], seq) {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// Escape an identifier, e.g. an email address or legacy user name, for use
+// as a localpart, as described by XEP-0106.
+func EscapeNode(node string) string {
+	var b strings.Builder
+	for i := 0; i < len(node); i++ {
+		c := node[i]
+		seq, ok := jidEscapes[c]
+		if ok && (c != '\\' || isJIDEscape(node[i:])) {
+			b.WriteString(seq)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Test if s starts with an escape sequence.
+func isJIDEscape(s string) bool {
+	_, ok := jidUnescape(s)
+	return ok
+}
+
+// Unescape a localpart escaped as described by XEP-0106. Backslashes that are
+// not part of an escape sequence are left as they are.
+func UnescapeNode(node string) string {
+	var b strings.Builder
+	for i := 0; i < len(node); i++ {
+		if c, ok := jidUnescape(node[i:]); ok {
+			b.WriteByte(c)
+			i += 2
+			continue
+		}
+		b.WriteByte(node[i])
+	}
+	return b.String()
+}
+
+// Create a JID from an unescaped identifier, e.g. an email address, mapped
+// into the domain. The identifier is escaped with EscapeNode and the JID is
+// validated as by ParseJID. XEP-0106 does not allow identifiers that start or
+// end with a space.
+func EscapedJID(node, domain, resource string) (JID, error) {
+	if strings.HasPrefix(node, " ") || strings.HasSuffix(node, " ") {
+		return JID{}, fmt.Errorf("%w: node %q starts or ends with a space", ErrInvalidJID, node)
+	}
+	s := EscapeNode(node) + "@" + domain
+	if resource != "" {
+		s += "/" + resource
+	}
+	return ParseJID(s)
+}
+
+// Return the JID's localpart, unescaped as described by XEP-0106.
+func (jid JID) UnescapedNode() string {
+	return UnescapeNode(jid.Node)
+}
+
+// Implement encoding.TextMarshaler. The zero JID is encoded as "".
+func (jid JID) MarshalText() ([]byte, error) {
+	return []byte(jid.Full()), nil
+}
+
+// Implement encoding.TextUnmarshaler. "" is decoded as the zero JID, anything
+// else must be a valid JID.
+func (jid *JID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*jid = JID{}
+		return nil
+	}
+	parsed, err := ParseJID(string(text))
+	if err != nil {
+		return err
+	}
+	*jid = parsed
+	return nil
+}
+
+// Implement xml.MarshalerAttr. The attribute is omitted for the zero JID.
+func (jid JID) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if jid == (JID{}) {
+		return xml.Attr{}, nil
+	}
+	return xml.Attr{Name: name, Value: jid.Full()}, nil
+}
+
+// Implement xml.UnmarshalerAttr.
+func (jid *JID) UnmarshalXMLAttr(attr xml.Attr) error {
+	return jid.UnmarshalText([]byte(attr.Value))
+}
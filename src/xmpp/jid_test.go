@@ -1,6 +1,11 @@
 package xmpp
 
-import "testing"
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestBare(t *testing.T) {
 	if (JID{"node", "domain", "resource"}).Bare() != "node@domain" {
@@ -34,3 +39,220 @@ func TestParseJID(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// Examples from RFC 7622 section 3.5, plus normalisation cases.
+func TestParseJIDValid(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected JID
+	}{
+		{"juliet@example.com", JID{"juliet", "example.com", ""}},
+		{"juliet@example.com/foo", JID{"juliet", "example.com", "foo"}},
+		{"juliet@example.com/foo bar", JID{"juliet", "example.com", "foo bar"}},
+		{"juliet@example.com/foo@bar", JID{"juliet", "example.com", "foo@bar"}},
+		{"foo\\20bar@example.com", JID{"foo\\20bar", "example.com", ""}},
+		{"fussball@example.com", JID{"fussball", "example.com", ""}},
+		{"fußball@example.com", JID{"fußball", "example.com", ""}},
+		{"π@example.com", JID{"π", "example.com", ""}},
+		{"Σ@example.com/foo", JID{"σ", "example.com", "foo"}},
+		{"σ@example.com/foo", JID{"σ", "example.com", "foo"}},
+		{"ς@example.com/foo", JID{"ς", "example.com", "foo"}},
+		{"king@example.com/♚", JID{"king", "example.com", "♚"}},
+		{"example.com", JID{"", "example.com", ""}},
+		{"example.com/foobar", JID{"", "example.com", "foobar"}},
+		{"a.example.com/b@example.net", JID{"", "a.example.com", "b@example.net"}},
+		{"Juliet@Example.COM/Balcony", JID{"juliet", "example.com", "Balcony"}},
+		{"ｊｕｌｉｅｔ@example.com", JID{"juliet", "example.com", ""}},
+		{"juliet@example.com./foo/bar", JID{"juliet", "example.com", "foo/bar"}},
+		{"juliet@xn--bcher-kva.example", JID{"juliet", "bücher.example", ""}},
+		{"juliet@Bücher.example", JID{"juliet", "bücher.example", ""}},
+		{"juliet@example。com", JID{"juliet", "example.com", ""}},
+		{"juliet@[::1]/foo", JID{"juliet", "[::1]", "foo"}},
+		{"juliet@192.168.0.1", JID{"juliet", "192.168.0.1", ""}},
+		{"muc_service.example.com", JID{"", "muc_service.example.com", ""}},
+		{"example.com/foo bar", JID{"", "example.com", "foo bar"}},
+	}
+	for _, test := range tests {
+		jid, err := ParseJID(test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if jid != test.expected {
+			t.Errorf("%q: expected %#v, got %#v", test.s, test.expected, jid)
+		}
+	}
+}
+
+func TestParseJIDInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"\"juliet\"@example.com",
+		"foo bar@example.com",
+		"juliet@example.com/ foo",
+		"@example.com/",
+		"henryⅣ@example.com",
+		"♚@example.com",
+		"juliet@",
+		"/foobar",
+		"juliet@example.com/",
+		"@example.com",
+		"juliet@exa mple.com",
+		"juliet@-example.com",
+		"juliet@example..com",
+		"juliet@[192.168.0.1]",
+		"juliet@xn--a.example",
+		"juliet@" + strings.Repeat("a", 64) + ".example",
+		strings.Repeat("a", 1024) + "@example.com",
+		"juliet@example.com/" + strings.Repeat("a", 1024),
+		"juliet@example.com/foo\u0007",
+	}
+	for _, s := range tests {
+		if jid, err := ParseJID(s); !errors.Is(err, ErrInvalidJID) {
+			t.Errorf("%q: expected error, got %#v, %v", s, jid, err)
+		}
+	}
+}
+
+func TestJIDEqual(t *testing.T) {
+	a := JID{"Juliet", "EXAMPLE.com", "balcony"}
+	if !a.Equal(MustParseJID("juliet@example.com/balcony")) {
+		t.Error("expected equal")
+	}
+	if a.Equal(MustParseJID("juliet@example.com/Balcony")) {
+		t.Error("resource comparison must be case sensitive")
+	}
+	if !a.BareEqual(MustParseJID("juliet@example.com/chamber")) {
+		t.Error("expected bare equal")
+	}
+	if a.BareEqual(MustParseJID("romeo@example.com/balcony")) {
+		t.Error("unexpected bare equal")
+	}
+}
+
+func TestMustParseJID(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	MustParseJID("juliet@")
+}
+
+// Samples from RFC 3492 section 7.1, and others.
+func TestPunycode(t *testing.T) {
+	tests := []struct {
+		decoded, encoded string
+	}{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+		{"☃", "n3h"},
+	}
+	for _, test := range tests {
+		if encoded := punycodeEncode(test.decoded); encoded != test.encoded {
+			t.Errorf("encode %q: expected %q, got %q", test.decoded, test.encoded, encoded)
+		}
+		if decoded, err := punycodeDecode(test.encoded); err != nil || decoded != test.decoded {
+			t.Errorf("decode %q: expected %q, got %q, %v", test.encoded, test.decoded, decoded, err)
+		}
+	}
+}
+
+// Examples from XEP-0106 section 5.1.
+var jidEscapeTests = []struct {
+	unescaped, escaped string
+}{
+	{"space cadet", `space\20cadet`},
+	{`call me "ishmael"`, `call\20me\20\22ishmael\22`},
+	{"at&t guy", `at\26t\20guy`},
+	{"d'artagnan", `d\27artagnan`},
+	{"/.fanboy", `\2f.fanboy`},
+	{"::foo::", `\3a\3afoo\3a\3a`},
+	{"<foo>", `\3cfoo\3e`},
+	{"user@host", `user\40host`},
+	{`c:\net`, `c\3a\net`},
+	{`c:\\net`, `c\3a\\net`},
+	{`c:\cool stuff`, `c\3a\cool\20stuff`},
+	{`c:\5commas`, `c\3a\5c5commas`},
+}
+
+func TestEscapeNode(t *testing.T) {
+	for _, test := range jidEscapeTests {
+		if escaped := EscapeNode(test.unescaped); escaped != test.escaped {
+			t.Errorf("escape %q: expected %q, got %q", test.unescaped, test.escaped, escaped)
+		}
+		if unescaped := UnescapeNode(test.escaped); unescaped != test.unescaped {
+			t.Errorf("unescape %q: expected %q, got %q", test.escaped, test.unescaped, unescaped)
+		}
+	}
+}
+
+func TestEscapedJID(t *testing.T) {
+	for _, test := range jidEscapeTests {
+		jid, err := EscapedJID(test.unescaped, "example.com", "")
+		if err != nil {
+			t.Errorf("%q: %v", test.unescaped, err)
+			continue
+		}
+		if jid.Node != test.escaped || jid.UnescapedNode() != test.unescaped {
+			t.Errorf("%q: unexpected JID %#v", test.unescaped, jid)
+		}
+	}
+	jid, err := EscapedJID("Alice@Example.org", "gateway.example.com", "res")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jid.Full() != `alice\40example.org@gateway.example.com/res` {
+		t.Errorf("unexpected JID %s", jid)
+	}
+	for _, node := range []string{" alice", "alice ", ""} {
+		if _, err := EscapedJID(node, "example.com", ""); !errors.Is(err, ErrInvalidJID) {
+			t.Errorf("%q: expected error, got %v", node, err)
+		}
+	}
+}
+
+func TestJIDMarshal(t *testing.T) {
+	type item struct {
+		XMLName xml.Name `xml:"item"`
+		JID     JID      `xml:"jid,attr"`
+		Owner   JID      `xml:"owner,attr"`
+		Contact JID      `xml:"contact"`
+	}
+	in := item{JID: MustParseJID("juliet@example.com/balcony"), Contact: MustParseJID("romeo@example.net")}
+	b, err := xml.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `<item jid="juliet@example.com/balcony"><contact>romeo@example.net</contact></item>` {
+		t.Errorf("unexpected xml: %s", b)
+	}
+	var out item
+	if err := xml.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.JID != in.JID || out.Owner != (JID{}) || out.Contact != in.Contact {
+		t.Errorf("unexpected item: %#v", out)
+	}
+	if err := xml.Unmarshal([]byte(`<item jid="juliet@"/>`), &out); !errors.Is(err, ErrInvalidJID) {
+		t.Errorf("expected invalid JID error, got %v", err)
+	}
+}
+
+func TestStanzaJIDs(t *testing.T) {
+	msg := &Message{To: "Juliet@Example.com/balcony"}
+	if to, err := msg.ToJID(); err != nil || to != (JID{"juliet", "example.com", "balcony"}) {
+		t.Errorf("unexpected to: %#v, %v", to, err)
+	}
+	if from, err := msg.FromJID(); err != nil || from != (JID{}) {
+		t.Errorf("unexpected from: %#v, %v", from, err)
+	}
+	iq := &IQ{From: "@example.com"}
+	if _, err := iq.FromJID(); !errors.Is(err, ErrInvalidJID) {
+		t.Errorf("expected invalid JID error, got %v", err)
+	}
+}
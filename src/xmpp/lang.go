@@ -0,0 +1,133 @@
+package xmpp
+
+import (
+	"strings"
+)
+
+// Choose between alternative texts in different languages, e.g. a message's
+// bodies. n is the number of alternatives and lang returns the xml:lang of
+// alternative i, "" if it has none. An alternative without a language is in
+// the stanza's language, defaultLang, which is normally the stream's
+// language if the stanza does not have one (see Stream.RecvLang).
+//
+// The preferred languages, most preferred first, are matched using the
+// lookup scheme of RFC 4647 section 3.4: each language tag is compared
+// case-insensitively, then progressively truncated, e.g. "en-GB" also matches
+// "en". If none of the languages match, the alternative in defaultLang is
+// chosen, and failing that the first alternative.
+//
+// Returns the index of the chosen alternative, or -1 if n is 0.
+func SelectLanguage(n int, lang func(i int) string, defaultLang string, preferred []string) int {
+	if n == 0 {
+		return -1
+	}
+	effective := func(i int) string {
+		if l := lang(i); l != "" {
+			return l
+		}
+		return defaultLang
+	}
+	find := func(tag string) int {
+		for i := 0; i < n; i++ {
+			if strings.EqualFold(effective(i), tag) {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, tag := range preferred {
+		for tag != "" {
+			if i := find(tag); i >= 0 {
+				return i
+			}
+			tag = truncateLanguageTag(tag)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if lang(i) == "" {
+			return i
+		}
+	}
+	if i := find(defaultLang); defaultLang != "" && i >= 0 {
+		return i
+	}
+	return 0
+}
+
+// Remove the last subtag of the language tag, and any single character
+// subtag left at the end (RFC 4647 section 3.4). Returns "" when nothing is
+// left.
+func truncateLanguageTag(tag string) string {
+	i := strings.LastIndexByte(tag, '-')
+	if i < 0 {
+		return ""
+	}
+	tag = tag[:i]
+	if j := strings.LastIndexByte(tag, '-'); j >= 0 && j == len(tag)-2 {
+		tag = tag[:j]
+	}
+	return tag
+}
+
+// Return the stanza with its xml:lang set to lang if it has none, copying the
+// stanza rather than modifying it. Anything else is returned as is.
+func withDefaultLang(v interface{}, lang string) interface{} {
+	if lang == "" {
+		return v
+	}
+	switch s := v.(type) {
+	case *IQ:
+		if s.Lang == "" {
+			c := *s
+			c.Lang = lang
+			return &c
+		}
+	case IQ:
+		if s.Lang == "" {
+			s.Lang = lang
+			return s
+		}
+	case *Message:
+		if s.Lang == "" {
+			c := *s
+			c.Lang = lang
+			return &c
+		}
+	case Message:
+		if s.Lang == "" {
+			s.Lang = lang
+			return s
+		}
+	case *Presence:
+		if s.Lang == "" {
+			c := *s
+			c.Lang = lang
+			return &c
+		}
+	case Presence:
+		if s.Lang == "" {
+			s.Lang = lang
+			return s
+		}
+	}
+	return v
+}
+
+// Set the xml:lang of an incoming stanza to lang if it has none, so the
+// language the stanza inherited from the stream is explicit.
+func setDefaultLang(v interface{}, lang string) {
+	switch s := v.(type) {
+	case *IQ:
+		if s.Lang == "" {
+			s.Lang = lang
+		}
+	case *Message:
+		if s.Lang == "" {
+			s.Lang = lang
+		}
+	case *Presence:
+		if s.Lang == "" {
+			s.Lang = lang
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectLanguage(t *testing.T) {
+	msg := &Message{Lang: "en", Body: []MessageBody{
+		{Value: "Hello"},
+		{Lang: "fr", Value: "Bonjour"},
+		{Lang: "de-CH", Value: "Grüezi"},
+	}}
+	tests := []struct {
+		langs []string
+		body  string
+	}{
+		{nil, "Hello"},
+		{[]string{"FR"}, "Bonjour"},
+		{[]string{"fr-CA"}, "Bonjour"},
+		{[]string{"de-CH-x-zh"}, "Grüezi"},
+		{[]string{"de"}, "Hello"},
+		{[]string{"it", "fr"}, "Bonjour"},
+		{[]string{"en-GB", "fr"}, "Hello"},
+	}
+	for _, test := range tests {
+		if body := msg.BodyFor(test.langs...); body != test.body {
+			t.Errorf("%v: expected %q, got %q", test.langs, test.body, body)
+		}
+	}
+
+	msg = &Message{Subject: []MessageSubject{{Lang: "fr", Value: "Thé"}, {Lang: "en", Value: "Tea"}}}
+	if subject := msg.SubjectFor("de"); subject != "Thé" {
+		t.Errorf("expected first subject, got %q", subject)
+	}
+	msg.Lang = "en"
+	if subject := msg.SubjectFor("de"); subject != "Tea" {
+		t.Errorf("expected default language subject, got %q", subject)
+	}
+	if body := msg.BodyFor("en"); body != "" {
+		t.Errorf("expected no body, got %q", body)
+	}
+}
+
+func TestStreamLang(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	stream := newStream(client, &StreamConfig{CloseTimeout: 100 * time.Millisecond})
+	s := &testServer{conn: server, dec: xml.NewDecoder(server)}
+	go func() {
+		s.dec.Token()
+		s.send(t, "<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' xml:lang='fr'>")
+	}()
+	if _, err := stream.SendStart(&xml.StartElement{
+		Name: xml.Name{Space: nsStreams, Local: "stream"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Space: "xmlns", Local: "stream"}, Value: nsStreams},
+			{Name: xml.Name{Space: nsXML, Local: "lang"}, Value: "en"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stream.SendLang() != "en" || stream.RecvLang() != "fr" {
+		t.Fatalf("expected languages en and fr, got %q and %q", stream.SendLang(), stream.RecvLang())
+	}
+	x := newXMPP(JID{"alice", "wonderland.lit", "test"}, stream)
+
+	msg := &Message{To: "hatter@wonderland.lit", Body: []MessageBody{{Value: "Hello"}}}
+	go func() {
+		if err := x.Send(context.Background(), msg); err != nil {
+			t.Error(err)
+		}
+	}()
+	sent := &Message{}
+	if err := s.dec.Decode(sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Lang != "en" || msg.Lang != "" {
+		t.Errorf("unexpected language: sent %q, original %q", sent.Lang, msg.Lang)
+	}
+
+	s.send(t, "<message from='hatter@wonderland.lit/tea'><body>Salut</body><body xml:lang='en'>Hi</body></message>")
+	received := (<-x.In).(*Message)
+	if received.Lang != "fr" || received.BodyFor("fr") != "Salut" || received.BodyFor("en") != "Hi" {
+		t.Errorf("unexpected message: %+v", received)
+	}
+}
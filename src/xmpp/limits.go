@@ -0,0 +1,235 @@
+package xmpp
+
+// Default limits on incoming data. See StreamConfig.
+const (
+	DefaultMaxStanzaBytes = 1 << 20
+	DefaultMaxDepth       = 64
+	DefaultMaxAttributes  = 64
+)
+
+// Scanner states.
+const (
+	limiterText      = iota // Character data.
+	limiterTagOpen          // After '<'.
+	limiterStartTag         // In a start tag.
+	limiterEndTag           // In an end tag.
+	limiterBang             // After "<!".
+	limiterCDATA            // In a CDATA section.
+	limiterProcInst         // In a processing instruction.
+	limiterReference        // In an entity or character reference.
+)
+
+// Maximum length of a reference's name that's checked. Longer names are not
+// predefined entities.
+const maxReferenceName = 8
+
+// Enforces a stream's limits on the raw incoming data. The data is scanned a
+// byte at a time, before it's parsed, so the limits are enforced however the
+// data is split into tokens. The XML is not validated, that's left to the
+// decoder, only enough is understood to track element depth, count attributes
+// and spot restricted XML.
+//
+// Depth is counted from the start of the document, i.e. the stream's start
+// element is at depth 1 and the stanzas at depth 2.
+type xmlLimiter struct {
+	maxStanzaBytes int64
+	maxDepth       int
+	maxAttributes  int
+
+	state      int
+	returnTo   int  // State to return to after a reference.
+	quote      byte // Quote of the attribute value being scanned, if any.
+	prev       byte
+	depth      int
+	attributes int
+	stanzaSize int64
+	name       []byte // Name of the PI, "<!" construct or reference.
+}
+
+func newXMLLimiter(config *StreamConfig) *xmlLimiter {
+	l := &xmlLimiter{
+		maxStanzaBytes: config.MaxStanzaBytes,
+		maxDepth:       config.MaxDepth,
+		maxAttributes:  config.MaxAttributes,
+	}
+	if l.maxStanzaBytes == 0 {
+		l.maxStanzaBytes = DefaultMaxStanzaBytes
+	}
+	if l.maxDepth == 0 {
+		l.maxDepth = DefaultMaxDepth
+	}
+	if l.maxAttributes == 0 {
+		l.maxAttributes = DefaultMaxAttributes
+	}
+	return l
+}
+
+// Start scanning a new document.
+func (l *xmlLimiter) reset() {
+	l.state, l.quote, l.prev = limiterText, 0, 0
+	l.depth, l.attributes, l.stanzaSize = 0, 0, 0
+	l.name = l.name[:0]
+}
+
+// Check the next byte of data.
+func (l *xmlLimiter) check(b byte) error {
+
+	// Size of the current top-level element, or of the data between them.
+	l.stanzaSize++
+	if l.maxStanzaBytes > 0 && l.stanzaSize > l.maxStanzaBytes {
+		return &StreamError{Condition: StreamErrorPolicyViolation, Text: "Maximum stanza size exceeded"}
+	}
+
+	prev := l.prev
+	l.prev = b
+
+	switch l.state {
+
+	case limiterText:
+		switch b {
+		case '<':
+			l.state = limiterTagOpen
+		case '&':
+			l.startReference()
+		}
+
+	case limiterTagOpen:
+		switch b {
+		case '/':
+			l.state = limiterEndTag
+		case '!':
+			l.state = limiterBang
+			l.name = l.name[:0]
+		case '?':
+			l.state = limiterProcInst
+			l.name = l.name[:0]
+		default:
+			l.state = limiterStartTag
+			l.attributes = 0
+		}
+
+	case limiterStartTag:
+		switch {
+		case l.quote != 0:
+			switch b {
+			case l.quote:
+				l.quote = 0
+			case '&':
+				l.startReference()
+			}
+		case b == '"' || b == '\'':
+			l.quote = b
+		case b == '=':
+			l.attributes++
+			if l.maxAttributes > 0 && l.attributes > l.maxAttributes {
+				return &StreamError{Condition: StreamErrorPolicyViolation, Text: "Maximum number of attributes exceeded"}
+			}
+		case b == '>':
+			l.state = limiterText
+			if prev == '/' {
+				l.endElement()
+				break
+			}
+			l.depth++
+			if l.depth == 1 {
+				// Don't count the stream's start element against the
+				// first stanza.
+				l.stanzaSize = 0
+			}
+			if l.maxDepth > 0 && l.depth-1 > l.maxDepth {
+				return &StreamError{Condition: StreamErrorPolicyViolation, Text: "Maximum element depth exceeded"}
+			}
+		}
+
+	case limiterEndTag:
+		if b == '>' {
+			l.state = limiterText
+			l.depth--
+			l.endElement()
+		}
+
+	case limiterBang:
+		// Only CDATA sections are allowed, not comments or DTDs.
+		l.name = append(l.name, b)
+		if string(l.name) != "[CDATA["[:len(l.name)] {
+			return &StreamError{Condition: StreamErrorRestrictedXML, Text: "Comments and DTDs are not allowed"}
+		}
+		if len(l.name) == len("[CDATA[") {
+			l.state = limiterCDATA
+			l.name = l.name[:0]
+		}
+
+	case limiterCDATA:
+		// Track the last two bytes to find "]]>".
+		if b == '>' && len(l.name) == 2 && string(l.name) == "]]" {
+			l.state = limiterText
+		}
+		if b == ']' {
+			if len(l.name) < 2 {
+				l.name = append(l.name, b)
+			}
+		} else {
+			l.name = l.name[:0]
+		}
+
+	case limiterProcInst:
+		// Only the XML declaration, before the stream's start element, is
+		// allowed.
+		if len(l.name) < 4 {
+			l.name = append(l.name, b)
+			if len(l.name) == 4 || b == '>' {
+				if l.depth != 0 || !isXMLDecl(l.name) {
+					return &StreamError{Condition: StreamErrorRestrictedXML, Text: "Processing instructions are not allowed"}
+				}
+			}
+		}
+		if b == '>' && prev == '?' {
+			l.state = limiterText
+		}
+
+	case limiterReference:
+		if b != ';' {
+			if len(l.name) <= maxReferenceName {
+				l.name = append(l.name, b)
+			}
+			break
+		}
+		l.state = l.returnTo
+		switch name := string(l.name); {
+		case len(name) > 1 && name[0] == '#':
+		case name == "lt", name == "gt", name == "amp", name == "apos", name == "quot":
+		default:
+			return &StreamError{Condition: StreamErrorRestrictedXML, Text: "Entity references are not allowed"}
+		}
+	}
+
+	return nil
+}
+
+// Start scanning a reference, returning to the current state at its end.
+func (l *xmlLimiter) startReference() {
+	l.returnTo = l.state
+	l.state = limiterReference
+	l.name = l.name[:0]
+}
+
+// Called when an element ends. The stanza size is reset when a top-level
+// element ends.
+func (l *xmlLimiter) endElement() {
+	if l.depth <= 1 {
+		l.stanzaSize = 0
+	}
+}
+
+// Test if the start of a processing instruction's data is the target of the
+// XML declaration.
+func isXMLDecl(b []byte) bool {
+	if len(b) < 4 || string(b[:3]) != "xml" {
+		return false
+	}
+	switch b[3] {
+	case ' ', '\t', '\r', '\n', '?':
+		return true
+	}
+	return false
+}
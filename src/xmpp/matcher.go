@@ -0,0 +1,185 @@
+package xmpp
+
+// Matcher that matches if all of the matchers match. No matchers always
+// matches.
+func And(matchers ...Matcher) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			for _, m := range matchers {
+				if !m.Match(v) {
+					return false
+				}
+			}
+			return true
+		},
+	)
+}
+
+// Matcher that matches if any of the matchers match. No matchers never
+// matches.
+func Or(matchers ...Matcher) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			for _, m := range matchers {
+				if m.Match(v) {
+					return true
+				}
+			}
+			return false
+		},
+	)
+}
+
+// Matcher that matches if m does not match.
+func Not(m Matcher) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			return !m.Match(v)
+		},
+	)
+}
+
+// Matcher to identify stanzas by element name, i.e. "iq", "message",
+// "presence" or "error".
+func StanzaKind(kind string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			return stanzaKind(v) == kind
+		},
+	)
+}
+
+// Matcher to identify <iq/>, <message/> or <presence/> stanzas by their type
+// attribute. A message with no type is treated as MessageTypeNormal.
+func StanzaType(stanzaType string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			switch v := v.(type) {
+			case *IQ:
+				return v.Type == stanzaType
+			case *Message:
+				if v.Type == "" {
+					return stanzaType == MessageTypeNormal
+				}
+				return v.Type == stanzaType
+			case *Presence:
+				return string(v.Type) == stanzaType
+			}
+			return false
+		},
+	)
+}
+
+// Matcher to identify stanzas sent from the JID's bare JID or any of its
+// resources.
+func FromBare(jid JID) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			from, ok := stanzaFrom(v)
+			if !ok {
+				return false
+			}
+			fromJID, err := ParseJID(from)
+			if err != nil {
+				return false
+			}
+			return fromJID.BareEqual(jid)
+		},
+	)
+}
+
+// Matcher to identify stanzas sent from exactly the JID.
+func FromFull(jid JID) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			from, ok := stanzaFrom(v)
+			if !ok {
+				return false
+			}
+			fromJID, err := ParseJID(from)
+			if err != nil {
+				return false
+			}
+			return fromJID.Equal(jid)
+		},
+	)
+}
+
+// Matcher to identify <iq/> stanzas with a payload in the namespace.
+func PayloadNamespace(space string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok {
+				return false
+			}
+			return iq.PayloadName().Space == space
+		},
+	)
+}
+
+// Matcher to identify stanzas with a child element in the namespace, e.g. a
+// message with a chat state notification.
+func ChildNamespace(space string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			return hasChildNamespace(v, space)
+		},
+	)
+}
+
+// Matcher to identify messages that are part of the thread.
+func MessageThread(thread string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			msg, ok := v.(*Message)
+			if !ok {
+				return false
+			}
+			return msg.Thread == thread
+		},
+	)
+}
+
+// Return the element name of a stanza, or "" if v is not a stanza.
+func stanzaKind(v interface{}) string {
+	switch v.(type) {
+	case *IQ:
+		return "iq"
+	case *Message:
+		return "message"
+	case *Presence:
+		return "presence"
+	case *Error:
+		return "error"
+	}
+	return ""
+}
+
+// Test if the stanza has a child element in the namespace: the payload of an
+// IQ, or one of the typed or other extensions of a message or presence.
+func hasChildNamespace(v interface{}, space string) bool {
+	switch v := v.(type) {
+	case *IQ:
+		return v.PayloadName().Space == space
+	case *Message:
+		var typed bool
+		switch space {
+		case NSHTTPAuth:
+			typed = v.Confirm != nil
+		case NSChatStatesNotification:
+			typed = v.Active != nil || v.Composing != nil || v.Paused != nil || v.Inactive != nil || v.Gone != nil
+		}
+		return typed || v.Extensions.Find(space) != nil
+	case *Presence:
+		var typed bool
+		switch space {
+		case NSVCardUpdate:
+			typed = v.VCardUpdate != nil
+		case NSNick:
+			typed = v.Nick != nil
+		}
+		return typed || v.Extensions.Find(space) != nil
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestMatchers(t *testing.T) {
+	bob := JID{"bob", "wonderland.lit", "phone"}
+	msg := &Message{Type: MessageTypeChat, From: bob.Full(), Thread: "t1", Active: &Active{}}
+	iq := &IQ{Type: IQTypeGet, From: "wonderland.lit", Payload: "<ping xmlns='urn:xmpp:ping'/>"}
+	receipt := &Message{Extensions: Extensions{{XMLName: xml.Name{Space: "urn:xmpp:receipts", Local: "request"}}}}
+	presence := &Presence{Nick: &Nick{Name: "Bob"}}
+	tests := []struct {
+		name  string
+		m     Matcher
+		v     interface{}
+		match bool
+	}{
+		{"and", And(StanzaKind("message"), StanzaType(MessageTypeChat)), msg, true},
+		{"and fail", And(StanzaKind("message"), StanzaType(MessageTypeNormal)), msg, false},
+		{"and empty", And(), msg, true},
+		{"or", Or(StanzaKind("iq"), StanzaKind("message")), msg, true},
+		{"or empty", Or(), msg, false},
+		{"not", Not(StanzaKind("presence")), msg, true},
+		{"from bare", FromBare(JID{"bob", "wonderland.lit", ""}), msg, true},
+		{"from bare other", FromBare(JID{"alice", "wonderland.lit", ""}), msg, false},
+		{"from full", FromFull(bob), msg, true},
+		{"from full other", FromFull(JID{"bob", "wonderland.lit", "laptop"}), msg, false},
+		{"payload ns", PayloadNamespace(NSPing), iq, true},
+		{"payload ns message", PayloadNamespace(NSPing), msg, false},
+		{"child ns", ChildNamespace(NSChatStatesNotification), msg, true},
+		{"child ns iq", ChildNamespace(NSPing), iq, true},
+		{"child ns extension", ChildNamespace("urn:xmpp:receipts"), receipt, true},
+		{"child ns extension other", ChildNamespace(NSChatStatesNotification), receipt, false},
+		{"child ns presence", ChildNamespace(NSNick), presence, true},
+		{"child ns presence other", ChildNamespace(NSVCardUpdate), presence, false},
+		{"thread", MessageThread("t1"), msg, true},
+		{"thread other", MessageThread("t2"), msg, false},
+		{"not a stanza", StanzaKind("message"), "message", false},
+	}
+	for _, test := range tests {
+		if test.m.Match(test.v) != test.match {
+			t.Errorf("%s: expected match %v", test.name, test.match)
+		}
+	}
+}
@@ -7,4 +7,5 @@ const (
 	nsComponentAccept = "jabber:component:accept"
 	nsErrorStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
 	nsErrorStreams    = "urn:ietf:params:xml:ns:xmpp-streams"
+	nsXML             = "http://www.w3.org/XML/1998/namespace"
 )
@@ -0,0 +1,91 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Characters that are allowed by the PRECIS IdentifierClass but not in a
+// JID's localpart, RFC 7622 section 3.3.1.
+const localpartExcluded = "\"&'/:<>@"
+
+// Prepare a JID's localpart using the PRECIS UsernameCaseMapped profile (RFC
+// 8265 section 3.3): full-width characters are mapped to their ASCII
+// equivalents, the result is lowercased and must then only contain the
+// characters allowed by the IdentifierClass (RFC 8264 section 4.2).
+func prepareLocalpart(s string) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		return unicode.ToLower(mapWidth(r))
+	}, s)
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	for _, r := range s {
+		if strings.ContainsRune(localpartExcluded, r) || !isIdentifierRune(r) {
+			return "", fmt.Errorf("contains %q", r)
+		}
+	}
+	return s, nil
+}
+
+// Prepare a JID's resourcepart using the PRECIS OpaqueString profile (RFC
+// 8265 section 4.2): non-ASCII spaces are mapped to ASCII spaces and the
+// result must then only contain the characters allowed by the FreeformClass
+// (RFC 8264 section 4.3). Case is preserved.
+func prepareResourcepart(s string) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if r != ' ' && unicode.Is(unicode.Zs, r) {
+			return ' '
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	if s[0] == ' ' {
+		// Not valid according to the examples in RFC 7622 section 3.5.
+		return "", errors.New("starts with a space")
+	}
+	for _, r := range s {
+		if !isFreeformRune(r) {
+			return "", fmt.Errorf("contains %q", r)
+		}
+	}
+	return s, nil
+}
+
+// Map a full-width ASCII character to its ASCII equivalent.
+func mapWidth(r rune) rune {
+	if r >= 0xFF01 && r <= 0xFF5E {
+		return r - 0xFF01 + 0x21
+	}
+	return r
+}
+
+// Test if the rune is allowed by the IdentifierClass: printable ASCII and
+// letters and digits (LetterDigits, RFC 5892 section 2.1).
+func isIdentifierRune(r rune) bool {
+	if r >= 0x21 && r <= 0x7E {
+		return true
+	}
+	return unicode.In(r, unicode.Ll, unicode.Lu, unicode.Lo, unicode.Lm, unicode.Nd, unicode.Mn, unicode.Mc)
+}
+
+// Test if the rune is allowed by the FreeformClass: as the IdentifierClass,
+// plus spaces, symbols, punctuation and other letters and digits. Controls,
+// format characters, private use, surrogates and unassigned code points are
+// not allowed.
+func isFreeformRune(r rune) bool {
+	if r == ' ' || isIdentifierRune(r) {
+		return true
+	}
+	return unicode.In(r, unicode.Lt, unicode.Nl, unicode.No, unicode.Me, unicode.P, unicode.S)
+}
+
+// BUG(jid): JID parts are not normalised to NFC, and the PRECIS
+// HasCompat and directionality (bidi) rules and the IDNA2008 contextual rules
+// are not enforced, as that needs Unicode tables not in the standard library.
+// The character classes are approximated using the Unicode general
+// categories.
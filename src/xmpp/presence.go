@@ -0,0 +1,164 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	NSNick = "http://jabber.org/protocol/nick"
+)
+
+// Presence type attribute (RFC 6121 section 4.7.1). The zero value means
+// available.
+type PresenceType string
+
+const (
+	PresenceTypeAvailable    PresenceType = ""
+	PresenceTypeUnavailable  PresenceType = "unavailable"
+	PresenceTypeError        PresenceType = "error"
+	PresenceTypeProbe        PresenceType = "probe"
+	PresenceTypeSubscribe    PresenceType = "subscribe"
+	PresenceTypeSubscribed   PresenceType = "subscribed"
+	PresenceTypeUnsubscribe  PresenceType = "unsubscribe"
+	PresenceTypeUnsubscribed PresenceType = "unsubscribed"
+)
+
+// Availability of an available resource (RFC 6121 section 4.7.2.1). The
+// zero value means plain available.
+type PresenceShow string
+
+const (
+	ShowAvailable PresenceShow = ""
+	ShowChat      PresenceShow = "chat"
+	ShowAway      PresenceShow = "away"
+	ShowXA        PresenceShow = "xa"
+	ShowDND       PresenceShow = "dnd"
+)
+
+// Priority of a resource (RFC 6121 section 4.7.2.3), from -128 to 127.
+type PresencePriority int8
+
+// Implement xml.Unmarshaler. A priority out of range is clamped and one
+// that's not a number is taken as 0, rather than failing the whole presence.
+func (p *PresencePriority) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	var s string
+	if err := dec.DecodeElement(&s, &start); err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		n = 0
+	}
+	switch {
+	case n < math.MinInt8:
+		n = math.MinInt8
+	case n > math.MaxInt8:
+		n = math.MaxInt8
+	}
+	*p = PresencePriority(n)
+	return nil
+}
+
+// Presence status text, optionally in a specific language.
+type PresenceStatus struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// XEP-0172: User Nickname
+
+type Nick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Name    string   `xml:",chardata"`
+}
+
+// Create an available presence with the show and status. The status is
+// omitted if "".
+func NewPresence(show PresenceShow, status string) *Presence {
+	presence := &Presence{Show: show}
+	presence.SetStatus("", status)
+	return presence
+}
+
+// Create an away presence with the status.
+func NewAwayPresence(status string) *Presence {
+	return NewPresence(ShowAway, status)
+}
+
+// Create an unavailable presence with the status.
+func NewUnavailablePresence(status string) *Presence {
+	presence := &Presence{Type: PresenceTypeUnavailable}
+	presence.SetStatus("", status)
+	return presence
+}
+
+// Create a directed presence (RFC 6121 section 4.6), a copy of presence
+// addressed to the JID.
+func NewDirectedPresence(to JID, presence *Presence) *Presence {
+	directed := *presence
+	directed.To = to.Full()
+	directed.Status = append([]PresenceStatus(nil), presence.Status...)
+	directed.Extensions = append(Extensions(nil), presence.Extensions...)
+	return &directed
+}
+
+// Return the status without a language, or the first status if they all have
+// one. Returns "" if there is no status.
+func (presence *Presence) StatusText() string {
+	for _, status := range presence.Status {
+		if status.Lang == "" {
+			return status.Value
+		}
+	}
+	if len(presence.Status) > 0 {
+		return presence.Status[0].Value
+	}
+	return ""
+}
+
+// Return the status in the most preferred of the languages, see
+// SelectLanguage. Returns "" if there is no status.
+func (presence *Presence) StatusFor(langs ...string) string {
+	i := SelectLanguage(len(presence.Status), func(i int) string { return presence.Status[i].Lang }, presence.Lang, langs)
+	if i < 0 {
+		return ""
+	}
+	return presence.Status[i].Value
+}
+
+// Set the status in the language, replacing any existing status in that
+// language. An empty status removes it.
+func (presence *Presence) SetStatus(lang, status string) {
+	statuses := presence.Status[:0:0]
+	for _, s := range presence.Status {
+		if s.Lang != lang {
+			statuses = append(statuses, s)
+		}
+	}
+	if status != "" {
+		statuses = append(statuses, PresenceStatus{Lang: lang, Value: status})
+	}
+	if len(statuses) == 0 {
+		statuses = nil
+	}
+	presence.Status = statuses
+}
+
+// Advertise the avatar's hex SHA-1 hash (XEP-0153). An empty hash advertises
+// that there is no avatar.
+func (presence *Presence) SetPhoto(hash string) {
+	presence.VCardUpdate = &VCardUpdate{Photo: &hash}
+}
+
+// Set the user's nickname (XEP-0172), or remove it if "".
+func (presence *Presence) SetNick(name string) {
+	if name == "" {
+		presence.Nick = nil
+		return
+	}
+	presence.Nick = &Nick{Name: name}
+}
@@ -0,0 +1,339 @@
+package xmpp
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Presence of one resource, as last received.
+type ResourcePresence struct {
+	// Full JID of the resource, or the bare JID for a presence error sent
+	// from the bare JID.
+	JID JID
+
+	// False once the resource has gone offline, or sent a presence error.
+	Available bool
+
+	Show     PresenceShow
+	Status   string
+	Priority int8
+
+	// Entity capabilities (XEP-0115), or nil.
+	Caps *Caps
+
+	// Time of the user's last interaction (XEP-0319), or zero if not idle.
+	Idle time.Time
+
+	// Error of a type="error" presence, or nil.
+	Error *Error
+
+	// When the presence was received.
+	Updated time.Time
+
+	// The presence stanza itself.
+	Presence *Presence
+}
+
+// Kind of presence transition.
+type PresenceEventType int
+
+const (
+	// A resource came online.
+	PresenceAvailable PresenceEventType = iota
+
+	// An available resource's show, status, priority, caps or idle time
+	// changed.
+	PresenceChanged
+
+	// A resource went offline.
+	PresenceUnavailable
+
+	// A presence error was received. All the affected resources are now
+	// unavailable.
+	PresenceError
+)
+
+// Presence transition.
+type PresenceEvent struct {
+	Type PresenceEventType
+
+	// The new presence, or the last presence of a resource that went offline
+	// with Available set to false.
+	Resource ResourcePresence
+}
+
+// Presence tracker (RFC 6121 section 4). Keeps track of the presence of each
+// resource the account receives presence from, and the directed presence
+// the account has sent.
+type PresenceTracker struct {
+	XMPP *XMPP
+	fid  FilterID
+
+	lock      sync.RWMutex
+	resources map[JID]map[string]ResourcePresence
+	directed  map[JID]bool
+	watchers  map[int]func(PresenceEvent)
+	nextWatch int
+}
+
+// Create a presence tracker and start tracking incoming presence. The
+// tracker only takes a copy of each presence; the stanzas are still delivered
+// as usual.
+func NewPresenceTracker(x *XMPP) *PresenceTracker {
+	t := &PresenceTracker{
+		XMPP:      x,
+		resources: make(map[JID]map[string]ResourcePresence),
+		directed:  make(map[JID]bool),
+		watchers:  make(map[int]func(PresenceEvent)),
+	}
+	m := And(StanzaKind("presence"), Or(StanzaType(string(PresenceTypeAvailable)), StanzaType(string(PresenceTypeUnavailable)), StanzaType(string(PresenceTypeError))))
+	fid, ch := x.AddFilterMode(m, FilterCopy)
+	t.fid = fid
+	go func() {
+		for v := range ch {
+			t.handle(v.(*Presence), time.Now())
+		}
+	}()
+	return t
+}
+
+// Stop tracking presence.
+func (t *PresenceTracker) Close() error {
+	return t.XMPP.RemoveFilter(t.fid)
+}
+
+// Call fn for each presence transition, until the returned func is called.
+// fn is called from the tracker's goroutine and must not block.
+func (t *PresenceTracker) Watch(fn func(PresenceEvent)) (cancel func()) {
+	t.lock.Lock()
+	id := t.nextWatch
+	t.nextWatch++
+	t.watchers[id] = fn
+	t.lock.Unlock()
+	return func() {
+		t.lock.Lock()
+		delete(t.watchers, id)
+		t.lock.Unlock()
+	}
+}
+
+func (t *PresenceTracker) handle(presence *Presence, now time.Time) {
+	from, err := presence.FromJID()
+	if err != nil || from.Domain == "" {
+		return
+	}
+	bare := from
+	bare.Resource = ""
+
+	t.lock.Lock()
+	var events []PresenceEvent
+	switch presence.Type {
+	case PresenceTypeError:
+		events = t.handleError(from, presence, now)
+	case PresenceTypeUnavailable:
+		if old, ok := t.resources[bare][from.Resource]; ok {
+			delete(t.resources[bare], from.Resource)
+			if len(t.resources[bare]) == 0 {
+				delete(t.resources, bare)
+			}
+			old.Available = false
+			old.Status = presence.StatusText()
+			old.Updated = now
+			old.Presence = presence
+			events = append(events, PresenceEvent{PresenceUnavailable, old})
+		}
+	default:
+		rp := newResourcePresence(from, presence, now)
+		old, ok := t.resources[bare][from.Resource]
+		if t.resources[bare] == nil {
+			t.resources[bare] = make(map[string]ResourcePresence)
+		}
+		t.resources[bare][from.Resource] = rp
+		switch {
+		case !ok:
+			events = append(events, PresenceEvent{PresenceAvailable, rp})
+		case !sameResourcePresence(old, rp):
+			events = append(events, PresenceEvent{PresenceChanged, rp})
+		}
+	}
+	watchers := make([]func(PresenceEvent), 0, len(t.watchers))
+	for _, fn := range t.watchers {
+		watchers = append(watchers, fn)
+	}
+	t.lock.Unlock()
+
+	for _, event := range events {
+		for _, fn := range watchers {
+			fn(event)
+		}
+	}
+}
+
+// Mark the resources the error applies to, the resource if from is a full
+// JID or all of them if it's a bare JID, as unavailable. Directed presence
+// that bounced is forgotten, the error often comes from the bare JID or the
+// domain the presence was sent to. Must be called with the lock held.
+func (t *PresenceTracker) handleError(from JID, presence *Presence, now time.Time) []PresenceEvent {
+	bare := from
+	bare.Resource = ""
+	for jid := range t.directed {
+		if jid == from || from.Resource == "" && jid.Domain == from.Domain && (from.Node == "" || jid.Node == from.Node) {
+			delete(t.directed, jid)
+		}
+	}
+
+	var events []PresenceEvent
+	for resource, old := range t.resources[bare] {
+		if from.Resource != "" && resource != from.Resource {
+			continue
+		}
+		delete(t.resources[bare], resource)
+		old.Available = false
+		old.Error = presence.Error
+		old.Updated = now
+		old.Presence = presence
+		events = append(events, PresenceEvent{PresenceError, old})
+	}
+	if len(t.resources[bare]) == 0 {
+		delete(t.resources, bare)
+	}
+	if len(events) == 0 {
+		rp := ResourcePresence{JID: from, Error: presence.Error, Updated: now, Presence: presence}
+		events = append(events, PresenceEvent{PresenceError, rp})
+	}
+	return events
+}
+
+func newResourcePresence(from JID, presence *Presence, now time.Time) ResourcePresence {
+	rp := ResourcePresence{
+		JID:       from,
+		Available: true,
+		Show:      presence.Show,
+		Status:    presence.StatusText(),
+		Priority:  int8(presence.Priority),
+		Updated:   now,
+		Presence:  presence,
+	}
+	caps := &Caps{}
+	if ok, err := presence.Extensions.Get(NSCaps, caps); ok && err == nil {
+		rp.Caps = caps
+	}
+	idle := &Idle{}
+	if ok, err := presence.Extensions.Get(NSIdle, idle); ok && err == nil {
+		rp.Idle = idle.Since
+	}
+	return rp
+}
+
+func sameResourcePresence(a, b ResourcePresence) bool {
+	if a.Show != b.Show || a.Status != b.Status || a.Priority != b.Priority || !a.Idle.Equal(b.Idle) {
+		return false
+	}
+	if a.Caps == nil || b.Caps == nil {
+		return a.Caps == b.Caps
+	}
+	return *a.Caps == *b.Caps
+}
+
+// Rank of each show value, most available first.
+var showRank = map[PresenceShow]int{
+	ShowChat:      0,
+	ShowAvailable: 1,
+	ShowAway:      2,
+	ShowXA:        3,
+	ShowDND:       4,
+}
+
+// Return true if a is more available than b: it has a higher priority, then
+// a more available show, then was updated more recently.
+func moreAvailable(a, b ResourcePresence) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if ra, rb := showRank[a.Show], showRank[b.Show]; ra != rb {
+		return ra < rb
+	}
+	return a.Updated.After(b.Updated)
+}
+
+// Return the presence of the full JID, or false if the resource is not
+// available.
+func (t *PresenceTracker) Presence(jid JID) (ResourcePresence, bool) {
+	jid = jid.normalise()
+	bare := jid
+	bare.Resource = ""
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	rp, ok := t.resources[bare][jid.Resource]
+	return rp, ok
+}
+
+// Return the available resources of the JID's bare JID, most available
+// first.
+func (t *PresenceTracker) Resources(jid JID) []ResourcePresence {
+	jid = jid.normalise()
+	jid.Resource = ""
+	t.lock.RLock()
+	resources := make([]ResourcePresence, 0, len(t.resources[jid]))
+	for _, rp := range t.resources[jid] {
+		resources = append(resources, rp)
+	}
+	t.lock.RUnlock()
+	sort.Slice(resources, func(i, j int) bool { return moreAvailable(resources[i], resources[j]) })
+	return resources
+}
+
+// Return the most available resource of the JID's bare JID, or false if none
+// is available. Resources with a negative priority are never chosen, as they
+// must not receive messages sent to the bare JID (RFC 6121 section 8.5.2).
+func (t *PresenceTracker) Best(jid JID) (ResourcePresence, bool) {
+	resources := t.Resources(jid)
+	if len(resources) == 0 || resources[0].Priority < 0 {
+		return ResourcePresence{}, false
+	}
+	return resources[0], true
+}
+
+// Return true if any resource of the JID's bare JID is available.
+func (t *PresenceTracker) Available(jid JID) bool {
+	jid = jid.normalise()
+	jid.Resource = ""
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.resources[jid]) > 0
+}
+
+// Send directed presence to the JID (RFC 6121 section 4.6), e.g. to an entity
+// that's not subscribed to the account's presence. The JID is remembered
+// until unavailable presence is sent to it, or it returns an error.
+func (t *PresenceTracker) SendDirected(ctx context.Context, to JID, presence *Presence) error {
+	p := *presence
+	p.To = to.Full()
+	if err := t.XMPP.Send(ctx, &p); err != nil {
+		return err
+	}
+	to = to.normalise()
+	t.lock.Lock()
+	if p.Type == PresenceTypeUnavailable {
+		delete(t.directed, to)
+	} else if p.Type == PresenceTypeAvailable {
+		t.directed[to] = true
+	}
+	t.lock.Unlock()
+	return nil
+}
+
+// Return the JIDs the account has sent directed available presence to,
+// sorted.
+func (t *PresenceTracker) Directed() []JID {
+	t.lock.RLock()
+	jids := make([]JID, 0, len(t.directed))
+	for jid := range t.directed {
+		jids = append(jids, jid)
+	}
+	t.lock.RUnlock()
+	sort.Slice(jids, func(i, j int) bool { return jids[i].Full() < jids[j].Full() })
+	return jids
+}
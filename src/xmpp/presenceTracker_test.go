@@ -0,0 +1,123 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	x, s := newTestXMPP(t)
+	tracker := NewPresenceTracker(x)
+	defer tracker.Close()
+	events := make(chan PresenceEvent, 10)
+	cancel := tracker.Watch(func(e PresenceEvent) { events <- e })
+	defer cancel()
+	go func() {
+		for range x.In {
+		}
+	}()
+
+	expect := func(eventType PresenceEventType, jid string) ResourcePresence {
+		select {
+		case e := <-events:
+			if e.Type != eventType || e.Resource.JID.Full() != jid {
+				t.Errorf("expected %v %s, got %v %s", eventType, jid, e.Type, e.Resource.JID)
+			}
+			return e.Resource
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %s", jid)
+		}
+		return ResourcePresence{}
+	}
+
+	s.send(t, "<presence from='hatter@wonderland.lit/tea'><show>away</show><priority>5</priority>"+
+		"<c xmlns='http://jabber.org/protocol/caps' hash='sha-1' node='https://tea.lit' ver='abc'/></presence>")
+	if rp := expect(PresenceAvailable, "hatter@wonderland.lit/tea"); rp.Caps == nil || rp.Caps.Ver != "abc" || rp.Priority != 5 {
+		t.Errorf("unexpected presence: %+v", rp)
+	}
+	s.send(t, "<presence from='hatter@wonderland.lit/party'><priority>5</priority>"+
+		"<idle xmlns='urn:xmpp:idle:1' since='2026-10-19T10:00:00Z'/></presence>")
+	if rp := expect(PresenceAvailable, "hatter@wonderland.lit/party"); !rp.Idle.Equal(time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected idle: %v", rp.Idle)
+	}
+
+	hatter := MustParseJID("Hatter@wonderland.lit")
+	if best, ok := tracker.Best(hatter); !ok || best.JID.Resource != "party" {
+		t.Errorf("unexpected best: %+v", best)
+	}
+
+	s.send(t, "<presence from='hatter@wonderland.lit/tea'><show>chat</show><priority>10</priority></presence>")
+	expect(PresenceChanged, "hatter@wonderland.lit/tea")
+	if best, _ := tracker.Best(hatter); best.JID.Resource != "tea" {
+		t.Errorf("unexpected best: %+v", best)
+	}
+
+	s.send(t, "<presence type='unavailable' from='hatter@wonderland.lit/tea'/>")
+	if rp := expect(PresenceUnavailable, "hatter@wonderland.lit/tea"); rp.Available {
+		t.Error("expected unavailable")
+	}
+	if resources := tracker.Resources(hatter); len(resources) != 1 {
+		t.Errorf("unexpected resources: %+v", resources)
+	}
+
+	s.send(t, "<presence type='error' from='hatter@wonderland.lit'><error type='cancel'>"+
+		"<remote-server-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>")
+	if rp := expect(PresenceError, "hatter@wonderland.lit/party"); rp.Error == nil || !rp.Error.Is(ErrorRemoteServerNotFound) {
+		t.Errorf("unexpected error: %+v", rp.Error)
+	}
+	if tracker.Available(hatter) {
+		t.Error("expected unavailable")
+	}
+
+	s.send(t, "<presence from='rabbit@wonderland.lit/watch'><priority>-1</priority></presence>")
+	expect(PresenceAvailable, "rabbit@wonderland.lit/watch")
+	rabbit := MustParseJID("rabbit@wonderland.lit")
+	if _, ok := tracker.Best(rabbit); ok || !tracker.Available(rabbit) {
+		t.Error("negative priority resource chosen")
+	}
+}
+
+func TestPresenceTrackerDirected(t *testing.T) {
+	x, s := newTestXMPP(t)
+	tracker := NewPresenceTracker(x)
+	defer tracker.Close()
+
+	room := MustParseJID("tea@party.wonderland.lit/alice")
+	go func() {
+		if err := tracker.SendDirected(context.Background(), room, &Presence{}); err != nil {
+			t.Error(err)
+		}
+	}()
+	presence := &Presence{}
+	if err := s.dec.Decode(presence); err != nil {
+		t.Fatal(err)
+	}
+	if presence.To != room.Full() {
+		t.Errorf("unexpected presence: %+v", presence)
+	}
+	waitFor(t, "directed presence", func() bool { return len(tracker.Directed()) == 1 })
+
+	go func() {
+		tracker.SendDirected(context.Background(), room, &Presence{Type: PresenceTypeUnavailable})
+	}()
+	if err := s.dec.Decode(presence); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "no directed presence", func() bool { return len(tracker.Directed()) == 0 })
+
+	// An error from the bare JID or the domain forgets the full JIDs.
+	go func() {
+		for range x.In {
+		}
+	}()
+	for _, from := range []string{"tea@party.wonderland.lit", "party.wonderland.lit"} {
+		go tracker.SendDirected(context.Background(), room, &Presence{})
+		if err := s.dec.Decode(presence); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "directed presence", func() bool { return len(tracker.Directed()) == 1 })
+		s.send(t, "<presence type='error' from='"+from+"'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>")
+		waitFor(t, "no directed presence after error from "+from, func() bool { return len(tracker.Directed()) == 0 })
+	}
+}
@@ -0,0 +1,79 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestPresenceMarshal(t *testing.T) {
+	presence := NewAwayPresence("Tea time")
+	presence.SetStatus("fr", "L'heure du thé")
+	presence.Priority = 5
+	presence.SetPhoto("")
+	presence.SetNick("Alice")
+	b, err := xml.Marshal(presence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<presence><show>away</show><status>Tea time</status><status xml:lang="fr">L&#39;heure du thé</status><priority>5</priority>` +
+		`<x xmlns="vcard-temp:x:update"><photo></photo></x><nick xmlns="http://jabber.org/protocol/nick">Alice</nick></presence>`
+	if string(b) != expected {
+		t.Errorf("unexpected presence: %s", b)
+	}
+
+	b, _ = xml.Marshal(NewUnavailablePresence(""))
+	if string(b) != `<presence type="unavailable"></presence>` {
+		t.Errorf("unexpected presence: %s", b)
+	}
+}
+
+func TestPresencePriority(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected PresencePriority
+	}{
+		{"<presence><priority> 10 </priority></presence>", 10},
+		{"<presence><priority>high</priority></presence>", 0},
+		{"<presence><priority>300</priority></presence>", 127},
+		{"<presence><priority>-99999999999999999999</priority></presence>", -128},
+		{"<presence><priority/></presence>", 0},
+	}
+	for _, test := range tests {
+		presence := &Presence{}
+		if err := xml.Unmarshal([]byte(test.s), presence); err != nil {
+			t.Errorf("%s: %v", test.s, err)
+			continue
+		}
+		if presence.Priority != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.s, test.expected, presence.Priority)
+		}
+	}
+}
+
+func TestPresenceUnmarshal(t *testing.T) {
+	presence := &Presence{}
+	err := xml.Unmarshal([]byte(`<presence from='hatter@wonderland.lit/tea'><show>dnd</show>`+
+		`<status xml:lang='fr'>Occupé</status><status>Busy</status><priority>-1</priority>`+
+		`<x xmlns='vcard-temp:x:update'><photo>abc</photo></x><nick xmlns='http://jabber.org/protocol/nick'>Hatter</nick></presence>`), presence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presence.Show != ShowDND || presence.Priority != -1 || presence.StatusText() != "Busy" || presence.Status[0].Lang != "fr" {
+		t.Errorf("unexpected presence: %+v", presence)
+	}
+	if presence.VCardUpdate == nil || presence.VCardUpdate.Photo == nil || *presence.VCardUpdate.Photo != "abc" {
+		t.Errorf("unexpected vcard update: %+v", presence.VCardUpdate)
+	}
+	if presence.Nick == nil || presence.Nick.Name != "Hatter" || len(presence.Extensions) != 0 {
+		t.Errorf("unexpected nick: %+v", presence.Nick)
+	}
+	if decoded, err := presence.Decoded(); err != nil || len(decoded) != 2 {
+		t.Errorf("unexpected decoded extensions: %v, %v", decoded, err)
+	}
+
+	directed := NewDirectedPresence(MustParseJID("tea@party.wonderland.lit/alice"), presence)
+	directed.SetStatus("", "")
+	if directed.To != "tea@party.wonderland.lit/alice" || len(directed.Status) != 1 || len(presence.Status) != 2 {
+		t.Errorf("unexpected directed presence: %+v", directed)
+	}
+}
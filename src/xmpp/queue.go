@@ -0,0 +1,300 @@
+package xmpp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Priority of an outgoing stanza. Queued stanzas are written in priority
+// order, highest first, and in the order they were sent within a priority.
+type Priority int
+
+const (
+	// Bulk traffic, e.g. messages.
+	PriorityBulk Priority = iota
+
+	// Anything that's not obviously bulk or urgent.
+	PriorityNormal
+
+	// Traffic that should not be held up, e.g. IQs and presence.
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+// Default number of stanzas that may wait in each priority lane of the
+// outgoing queue.
+const DefaultQueueSize = 256
+
+// Outgoing stanza queue configuration. The queue sits between the XMPP
+// instance's Out channel (and Send method) and the stream.
+type QueueConfig struct {
+	// Maximum sustained rate, in stanzas per second, that stanzas are written
+	// to the stream. Zero means unlimited.
+	Rate float64
+
+	// Maximum number of stanzas that may be written in a burst when Rate is
+	// set. Defaults to 1.
+	Burst int
+
+	// Maximum number of stanzas waiting in each priority lane. Sending blocks
+	// while the stanza's lane is full. Defaults to DefaultQueueSize.
+	Size int
+
+	// Return the priority of an outgoing stanza. Defaults to DefaultPriority.
+	Priority func(v interface{}) Priority
+}
+
+// Prioritise IQs and presence over messages, everything else is
+// PriorityNormal.
+func DefaultPriority(v interface{}) Priority {
+	switch v.(type) {
+	case IQ, *IQ, Presence, *Presence:
+		return PriorityHigh
+	case Message, *Message:
+		return PriorityBulk
+	}
+	return PriorityNormal
+}
+
+// Snapshot of the outgoing queue's metrics.
+type QueueStats struct {
+	// Number of stanzas waiting to be written, by priority.
+	Depth [numPriorities]int
+
+	// Highest total number of stanzas ever waiting.
+	MaxDepth int
+
+	// Number of stanzas written, by priority.
+	Sent [numPriorities]uint64
+
+	// Number of times writing was delayed by the rate limit.
+	Throttled uint64
+}
+
+// Request to write to the stream.
+type sendReq struct {
+	// Write function.
+	fn func() error
+
+	// Priority lane.
+	priority Priority
+
+	// True if the request writes the stream's closing tag.
+	end bool
+
+	// Receives the result of the write. Errors are logged if nil.
+	err chan error
+}
+
+// Priority queue of outgoing requests.
+type sendQueue struct {
+	priority func(v interface{}) Priority
+	bucket   *tokenBucket
+
+	// Semaphores bounding the size of each lane.
+	slots [numPriorities]chan struct{}
+
+	// Signalled when a request is added.
+	ready chan struct{}
+
+	lock   sync.Mutex
+	lanes  [numPriorities][]*sendReq
+	end    *sendReq
+	closed bool
+	stats  QueueStats
+}
+
+func newSendQueue(config *QueueConfig) *sendQueue {
+	if config == nil {
+		config = &QueueConfig{}
+	}
+	q := &sendQueue{priority: config.Priority, ready: make(chan struct{}, 1)}
+	if q.priority == nil {
+		q.priority = DefaultPriority
+	}
+	size := config.Size
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	for i := range q.slots {
+		q.slots[i] = make(chan struct{}, size)
+	}
+	if config.Rate > 0 {
+		q.bucket = newTokenBucket(config.Rate, config.Burst)
+	}
+	return q
+}
+
+// Add the request to its lane, waiting for space if the lane is full.
+func (q *sendQueue) push(ctx context.Context, req *sendReq, shutdown <-chan struct{}) error {
+	select {
+	case q.slots[req.priority] <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-shutdown:
+		return ErrStreamClosed
+	}
+
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		<-q.slots[req.priority]
+		return ErrStreamClosed
+	}
+	q.lanes[req.priority] = append(q.lanes[req.priority], req)
+	if depth := q.depth(); depth > q.stats.MaxDepth {
+		q.stats.MaxDepth = depth
+	}
+	q.lock.Unlock()
+
+	q.signal()
+	return nil
+}
+
+// Add the request that closes the stream. It's only returned by next once
+// all the lanes are empty and is not subject to the rate limit.
+func (q *sendQueue) pushEnd(req *sendReq) {
+	q.lock.Lock()
+	q.end = req
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Return the next request that can be written, waiting for one if block is
+// true. Returns nil if there is nothing to write right now and block is false,
+// or if shutdown is closed while waiting.
+func (q *sendQueue) next(block bool, shutdown <-chan struct{}) *sendReq {
+	for {
+		q.lock.Lock()
+		lane := -1
+		for i := numPriorities - 1; i >= 0; i-- {
+			if len(q.lanes[i]) > 0 {
+				lane = i
+				break
+			}
+		}
+
+		// Nothing queued, except maybe the end of the stream.
+		if lane == -1 {
+			req := q.end
+			q.end = nil
+			q.lock.Unlock()
+			if req != nil || !block {
+				return req
+			}
+			select {
+			case <-q.ready:
+				continue
+			case <-shutdown:
+				return nil
+			}
+		}
+
+		// Respect the rate limit.
+		if wait := q.bucket.take(time.Now()); wait > 0 {
+			if !block {
+				q.lock.Unlock()
+				return nil
+			}
+			q.stats.Throttled++
+			q.lock.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				continue
+			case <-shutdown:
+				timer.Stop()
+				return nil
+			}
+		}
+
+		req := q.lanes[lane][0]
+		q.lanes[lane][0] = nil
+		q.lanes[lane] = q.lanes[lane][1:]
+		q.stats.Sent[lane]++
+		q.lock.Unlock()
+
+		<-q.slots[lane]
+		return req
+	}
+}
+
+// Fail all queued requests with the error and refuse any more.
+func (q *sendQueue) close(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	for i, lane := range q.lanes {
+		for _, req := range lane {
+			if req.err != nil {
+				req.err <- err
+			}
+			<-q.slots[i]
+		}
+		q.lanes[i] = nil
+	}
+	if q.end != nil && q.end.err != nil {
+		q.end.err <- err
+	}
+	q.end = nil
+}
+
+// Total number of queued requests. Must be called with the lock held.
+func (q *sendQueue) depth() (depth int) {
+	for _, lane := range q.lanes {
+		depth += len(lane)
+	}
+	return
+}
+
+func (q *sendQueue) snapshot() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := q.stats
+	for i, lane := range q.lanes {
+		stats.Depth[i] = len(lane)
+	}
+	return stats
+}
+
+// Token bucket rate limiter. A nil *tokenBucket imposes no limit.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take a token if one is available, otherwise return how long until one will
+// be.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
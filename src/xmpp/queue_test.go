@@ -0,0 +1,75 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSendQueuePriority(t *testing.T) {
+	q := newSendQueue(nil)
+	var written []Priority
+	push := func(v interface{}) {
+		req := &sendReq{priority: q.priority(v)}
+		req.fn = func() error {
+			written = append(written, req.priority)
+			return nil
+		}
+		if err := q.push(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push(&Message{})
+	push(&Message{})
+	push(Presence{})
+	push(&IQ{})
+	q.pushEnd(&sendReq{fn: func() error { written = append(written, -1); return nil }, end: true})
+
+	stats := q.snapshot()
+	if stats.Depth != [numPriorities]int{2, 0, 2} || stats.MaxDepth != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	for i := 0; i < 5; i++ {
+		q.next(true, nil).fn()
+	}
+	expected := []Priority{PriorityHigh, PriorityHigh, PriorityBulk, PriorityBulk, -1}
+	for i := range expected {
+		if written[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, written)
+		}
+	}
+	if stats := q.snapshot(); stats.Sent != [numPriorities]uint64{2, 0, 2} {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	q := newSendQueue(&QueueConfig{Size: 1})
+	if err := q.push(context.Background(), &sendReq{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.push(ctx, &sendReq{}, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected push to block, got %v", err)
+	}
+	if err := q.push(context.Background(), &sendReq{priority: PriorityHigh}, nil); err != nil {
+		t.Errorf("full bulk lane blocked high priority lane: %v", err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2)
+	b.last = now
+	if b.take(now) != 0 || b.take(now) != 0 {
+		t.Fatalf("burst not allowed")
+	}
+	if wait := b.take(now); wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms, got %v", wait)
+	}
+	if b.take(now.Add(100*time.Millisecond)) != 0 {
+		t.Errorf("token not refilled")
+	}
+}
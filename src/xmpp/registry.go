@@ -0,0 +1,179 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Registry of the Go types used to decode IQ payloads and stanza extensions,
+// keyed by element name.
+var registry = struct {
+	sync.RWMutex
+	types map[xml.Name]reflect.Type
+}{types: make(map[xml.Name]reflect.Type)}
+
+func init() {
+	builtin := []interface{}{
+		&AdHocCommand{},
+		&AdHocXForm{},
+		&Active{},
+		&Caps{},
+		&Composing{},
+		&Paused{},
+		&Inactive{},
+		&Gone{},
+		&DiscoInfo{},
+		&DiscoItems{},
+		&Confirm{},
+		&Idle{},
+		&Nick{},
+		&Ping{},
+		&Preauth{},
+		&RegisterQuery{},
+		&RemoteRosterManagerQuery{},
+		&RosterQuery{},
+		&SoftwareVersion{},
+		&VCard{},
+		&VCardUpdate{},
+	}
+	for _, v := range builtin {
+		Register(v)
+	}
+}
+
+// Register the type of v, which must be a pointer to a struct, as the type
+// to decode elements into. The element name is taken from the XMLName
+// field's tag, e.g. `xml:"urn:xmpp:ping ping"`. Registering a name that's
+// already registered replaces the previous type. Panics if v has no element
+// name.
+func Register(v interface{}) {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("xmpp: Register of non-struct pointer %T", v))
+	}
+	name, ok := typeElementName(t.Elem())
+	if !ok {
+		panic(fmt.Sprintf("xmpp: Register of %T without an XMLName tag", v))
+	}
+	RegisterName(name, v)
+}
+
+// Register the type of v, which must be a pointer, as the type to decode
+// elements with the name into.
+func RegisterName(name xml.Name, v interface{}) {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("xmpp: RegisterName of non-pointer %T", v))
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.types[name] = t.Elem()
+}
+
+// Return a pointer to a new value of the type registered for the element
+// name, or nil if nothing is registered.
+func NewRegistered(name xml.Name) interface{} {
+	registry.RLock()
+	t, ok := registry.types[name]
+	registry.RUnlock()
+	if !ok {
+		return nil
+	}
+	return reflect.New(t).Interface()
+}
+
+// Return the element name from the XMLName field's tag.
+func typeElementName(t reflect.Type) (xml.Name, bool) {
+	f, ok := t.FieldByName("XMLName")
+	if !ok || f.Type != reflect.TypeOf(xml.Name{}) {
+		return xml.Name{}, false
+	}
+	tag := f.Tag.Get("xml")
+	if i := strings.Index(tag, ","); i != -1 {
+		tag = tag[:i]
+	}
+	var name xml.Name
+	if i := strings.LastIndex(tag, " "); i != -1 {
+		name.Space, name.Local = tag[:i], tag[i+1:]
+	} else {
+		name.Local = tag
+	}
+	return name, name.Local != ""
+}
+
+// Decode the payload into a new value of the type registered for the
+// payload's element name, e.g. a *DiscoInfo for a disco#info query. Returns
+// nil if there is no payload or nothing is registered for it.
+func (iq *IQ) Decoded() (interface{}, error) {
+	v := NewRegistered(iq.PayloadName())
+	if v == nil {
+		return nil, nil
+	}
+	if err := iq.PayloadDecode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Decode the extension into a new value of the type registered for its
+// element name. Returns nil if nothing is registered.
+func (e *Extension) Decoded() (interface{}, error) {
+	v := NewRegistered(e.XMLName)
+	if v == nil {
+		return nil, nil
+	}
+	if err := e.Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Decode the extensions that have a registered type, in order. Extensions
+// without a registered type are left out.
+func (exts Extensions) Decoded() ([]interface{}, error) {
+	var decoded []interface{}
+	for i := range exts {
+		v, err := exts[i].Decoded()
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			decoded = append(decoded, v)
+		}
+	}
+	return decoded, nil
+}
+
+// Return the message's extensions, decoded: those with fields of their own,
+// e.g. a *Composing chat state, followed by the decoded Extensions.
+func (msg *Message) Decoded() ([]interface{}, error) {
+	decoded := appendFields(nil, msg.Confirm, msg.Active, msg.Composing, msg.Paused, msg.Inactive, msg.Gone)
+	exts, err := msg.Extensions.Decoded()
+	if err != nil {
+		return nil, err
+	}
+	return append(decoded, exts...), nil
+}
+
+// Return the presence's extensions, decoded, as for Message.Decoded.
+func (presence *Presence) Decoded() ([]interface{}, error) {
+	decoded := appendFields(nil, presence.VCardUpdate, presence.Nick)
+	exts, err := presence.Extensions.Decoded()
+	if err != nil {
+		return nil, err
+	}
+	return append(decoded, exts...), nil
+}
+
+// Append the fields that aren't nil pointers.
+func appendFields(decoded []interface{}, fields ...interface{}) []interface{} {
+	for _, f := range fields {
+		if !reflect.ValueOf(f).IsNil() {
+			decoded = append(decoded, f)
+		}
+	}
+	return decoded
+}
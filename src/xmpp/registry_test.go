@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestIQDecoded(t *testing.T) {
+	iq := &IQ{Type: IQTypeResult}
+	iq.PayloadEncode(&DiscoInfo{Feature: []DiscoFeature{{NSPing}}})
+	v, err := iq.Decoded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := v.(*DiscoInfo)
+	if !ok || len(info.Feature) != 1 || info.Feature[0].Var != NSPing {
+		t.Fatalf("unexpected payload: %#v", v)
+	}
+
+	iq.Payload = "<ping xmlns='urn:xmpp:ping'/>"
+	if v, _ := iq.Decoded(); v == nil {
+		t.Error("expected *Ping")
+	} else if _, ok := v.(*Ping); !ok {
+		t.Errorf("expected *Ping, got %T", v)
+	}
+
+	for _, payload := range []string{"", "<query xmlns='urn:unknown'/>"} {
+		iq.Payload = payload
+		if v, err := iq.Decoded(); v != nil || err != nil {
+			t.Errorf("%q: unexpected result %v, %v", payload, v, err)
+		}
+	}
+}
+
+func TestExtensionsDecoded(t *testing.T) {
+	name := xml.Name{"urn:xmpp:receipts", "received"}
+	RegisterName(name, &testReceipt{})
+	t.Cleanup(func() {
+		registry.Lock()
+		delete(registry.types, name)
+		registry.Unlock()
+	})
+	in := "<message xmlns='jabber:client'>" +
+		"<received xmlns='urn:xmpp:receipts' id='1'/>" +
+		"<unknown xmlns='urn:unknown'/>" +
+		"</message>"
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(in), msg); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msg.Extensions.Decoded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 {
+		t.Fatalf("expected 1 decoded extension, got %d", len(decoded))
+	}
+	if receipt, ok := decoded[0].(*testReceipt); !ok || receipt.ID != "1" {
+		t.Errorf("unexpected extension: %#v", decoded[0])
+	}
+}
+
+func TestMessageDecoded(t *testing.T) {
+	in := "<message xmlns='jabber:client'>" +
+		"<composing xmlns='http://jabber.org/protocol/chatstates'/>" +
+		"<ping xmlns='urn:xmpp:ping'/>" +
+		"</message>"
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(in), msg); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msg.Decoded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("expected 2 decoded extensions, got %d", len(decoded))
+	}
+	if _, ok := decoded[0].(*Composing); !ok {
+		t.Errorf("expected *Composing, got %T", decoded[0])
+	}
+	if _, ok := decoded[1].(*Ping); !ok {
+		t.Errorf("expected *Ping, got %T", decoded[1])
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	for _, v := range []interface{}{nil, Ping{}, &struct{}{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for %T", v)
+				}
+			}()
+			Register(v)
+		}()
+	}
+}
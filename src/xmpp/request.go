@@ -0,0 +1,45 @@
+package xmpp
+
+import (
+	"context"
+)
+
+// Send an <iq type="get"/> request with the payload to the JID and decode the
+// result's payload into a new T. See Request.
+func Get[T any](ctx context.Context, x *XMPP, to string, payload interface{}) (*T, error) {
+	return Request[T](ctx, x, &IQ{Type: IQTypeGet, To: to, From: x.JID.Full()}, payload)
+}
+
+// Send an <iq type="set"/> request with the payload to the JID and decode the
+// result's payload into a new T. See Request.
+func Set[T any](ctx context.Context, x *XMPP, to string, payload interface{}) (*T, error) {
+	return Request[T](ctx, x, &IQ{Type: IQTypeSet, To: to, From: x.JID.Full()}, payload)
+}
+
+// Encode the payload into the request, if it's not nil, send the request and
+// wait for the response. The result's payload is decoded into a new T; a
+// result without a payload, as is common for sets, returns a zero T.
+//
+// An ID is generated if the request doesn't have one. An <iq type="error"/>
+// response is returned as an *IQError. See SendRecvContext.
+func Request[T any](ctx context.Context, x *XMPP, req *IQ, payload interface{}) (*T, error) {
+	if payload != nil {
+		if err := req.PayloadEncode(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(T)
+	if resp.PayloadName().Local == "" {
+		return result, nil
+	}
+	if err := resp.PayloadDecode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
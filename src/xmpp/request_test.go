@@ -0,0 +1,70 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDiscoInfo(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		if req.Type != IQTypeGet || req.To != "wonderland.lit" || req.From != x.JID.Full() || req.PayloadName().Space != NSDiscoInfo {
+			t.Errorf("unexpected request: %v", req)
+		}
+		s.send(t, "<iq type='result' from='wonderland.lit' id='"+req.ID+"'>"+
+			"<query xmlns='http://jabber.org/protocol/disco#info'><feature var='urn:xmpp:ping'/></query></iq>")
+	}()
+	disco := &Disco{x}
+	info, err := disco.Info("wonderland.lit", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Feature) != 1 || info.Feature[0].Var != NSPing {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestDiscoItemsError(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='error' from='wonderland.lit' id='"+req.ID+"'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>")
+	}()
+	_, err := (&Disco{x}).Items("wonderland.lit", "", "")
+	if stanzaErr, ok := err.(*Error); !ok || stanzaErr.Condition() != ErrorItemNotFound {
+		t.Errorf("expected *Error item-not-found, got %#v", err)
+	}
+}
+
+func TestSetEmptyResult(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		if req.Type != IQTypeSet || req.PayloadName().Space != NSRoster {
+			t.Errorf("unexpected request: %v", req)
+		}
+		s.send(t, "<iq type='result' id='"+req.ID+"'/>")
+	}()
+	result, err := Set[RosterQuery](context.Background(), x, "", &RosterQuery{Items: []RosterItem{{JID: "bob@wonderland.lit"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || len(result.Items) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestGetError(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='error' id='"+req.ID+"'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>")
+	}()
+	_, err := Get[SoftwareVersion](context.Background(), x, "", &SoftwareVersion{})
+	var stanzaErr *Error
+	if !errors.As(err, &stanzaErr) || stanzaErr.Condition() != ErrorServiceUnavailable {
+		t.Errorf("expected service-unavailable error, got %v", err)
+	}
+}
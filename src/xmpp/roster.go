@@ -1,26 +1,378 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"log"
+	"sort"
+	"sync"
 )
 
 const (
-	NSRoster = "jabber:iq:roster"
+	NSRoster    = "jabber:iq:roster"
+	NSRosterVer = "urn:xmpp:features:rosterver"
 
+	RosterSubscriptionNone   = "none"
 	RosterSubscriptionBoth   = "both"
 	RosterSubscriptionFrom   = "from"
 	RosterSubscriptionTo     = "to"
 	RosterSubscriptionRemove = "remove"
+
+	RosterAskSubscribe = "subscribe"
 )
 
 type RosterQuery struct {
 	XMLName xml.Name     `xml:"jabber:iq:roster query"`
+	Ver     string       `xml:"ver,attr,omitempty"`
 	Items   []RosterItem `xml:"item"`
 }
 
 type RosterItem struct {
 	JID          string   `xml:"jid,attr"`
 	Name         string   `xml:"name,attr,omitempty"`
-	Subscription string   `xml:"subscription,attr"`
-	Groupes      []string `xml:"group"`
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Ask          string   `xml:"ask,attr,omitempty"`
+	Approved     bool     `xml:"approved,attr,omitempty"`
+	Groups       []string `xml:"group"`
+}
+
+// Roster get request. Unlike RosterQuery, an empty version is sent, to tell
+// the server versioning is supported but nothing is cached.
+type rosterVerQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:roster query"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+// Persistent storage for a roster and its version, allowing the roster to be
+// fetched incrementally using roster versioning (XEP-0237). Implementations
+// must be safe for use by multiple goroutines.
+type RosterStore interface {
+	// Return the stored roster version and items. An empty version means
+	// there is no stored roster.
+	Load() (ver string, items []RosterItem, err error)
+
+	// Replace the stored roster.
+	Save(ver string, items []RosterItem) error
+}
+
+// Kind of roster change.
+type RosterEventType int
+
+const (
+	RosterItemAdded RosterEventType = iota
+	RosterItemUpdated
+	RosterItemRemoved
+)
+
+// Change to the roster.
+type RosterEvent struct {
+	Type RosterEventType
+
+	// The item after the change, or before it was removed.
+	Item RosterItem
+}
+
+// Roster configuration.
+type RosterConfig struct {
+	// Roster persistence. Roster versioning is only used if set, and the
+	// server supports it.
+	Store RosterStore
+
+	// Called for each change to the roster, whether it's from fetching the
+	// roster or a roster push. Called from the goroutine that made the change
+	// and must not block.
+	OnChange func(RosterEvent)
+}
+
+// Roster manager (RFC 6121 section 2). Keeps a copy of the account's roster,
+// up to date with the server's roster pushes. "Wraps" XMPP instance to provide
+// a more convenient API for roster management.
+type Roster struct {
+	XMPP   *XMPP
+	config *RosterConfig
+	fid    FilterID
+
+	lock  sync.RWMutex
+	ver   string
+	items map[JID]RosterItem
+}
+
+// Create a roster manager for the XMPP instance's account and start handling
+// roster pushes. Call Fetch to get the roster from the server.
+func NewRoster(x *XMPP, config *RosterConfig) *Roster {
+	if config == nil {
+		config = &RosterConfig{}
+	}
+	r := &Roster{XMPP: x, config: config, items: make(map[JID]RosterItem)}
+	if config.Store != nil {
+		ver, items, err := config.Store.Load()
+		if err != nil {
+			log.Println("Error. Failed to load roster. ", err)
+		} else {
+			r.ver = ver
+			r.replace(items)
+		}
+	}
+
+	// Only pushes from the account itself are genuine, RFC 6121 section
+	// 2.1.6. Anything else is left for other handlers.
+	m := And(IQRequest, StanzaType(IQTypeSet), PayloadNamespace(NSRoster), FromAccount(x.JID))
+	fid, ch := x.AddFilterMode(m, FilterExclusive)
+	r.fid = fid
+	go func() {
+		for v := range ch {
+			r.handlePush(v.(*IQ))
+		}
+	}()
+	return r
+}
+
+// Stop handling roster pushes.
+func (r *Roster) Close() error {
+	return r.XMPP.RemoveFilter(r.fid)
+}
+
+// Request the roster from the server. If the server supports roster
+// versioning and a stored roster is available, the server may only send the
+// changes since, as roster pushes.
+func (r *Roster) Fetch(ctx context.Context) error {
+	versioning := r.config.Store != nil && r.XMPP.features != nil && r.XMPP.features.RosterVer != nil
+
+	var payload interface{} = &RosterQuery{}
+	if versioning {
+		r.lock.RLock()
+		payload = &rosterVerQuery{Ver: r.ver}
+		r.lock.RUnlock()
+	}
+	query, err := Get[RosterQuery](ctx, r.XMPP, "", payload)
+	if err != nil {
+		return err
+	}
+
+	// An empty result means the stored roster is up to date.
+	if query.XMLName.Local == "" {
+		return nil
+	}
+
+	r.lock.Lock()
+	events := r.replace(query.Items)
+	if versioning {
+		r.ver = query.Ver
+	}
+	r.lock.Unlock()
+
+	r.save()
+	r.emit(events)
+	return nil
+}
+
+// Replace the items, returning the changes. Must be called with the lock
+// held, or before the roster is shared.
+func (r *Roster) replace(items []RosterItem) []RosterEvent {
+	var events []RosterEvent
+	seen := make(map[JID]bool)
+	for _, item := range items {
+		jid, err := ParseJID(item.JID)
+		if err != nil {
+			log.Println("Error. Invalid roster item. ", err)
+			continue
+		}
+		jid.Resource = ""
+		seen[jid] = true
+		if event, ok := r.update(jid, item); ok {
+			events = append(events, event)
+		}
+	}
+	for jid, item := range r.items {
+		if !seen[jid] {
+			delete(r.items, jid)
+			events = append(events, RosterEvent{RosterItemRemoved, item})
+		}
+	}
+	return events
+}
+
+// Add, update or remove the item. Returns false if nothing changed. Must be
+// called with the lock held.
+func (r *Roster) update(jid JID, item RosterItem) (RosterEvent, bool) {
+	old, exists := r.items[jid]
+	if item.Subscription == RosterSubscriptionRemove {
+		if !exists {
+			return RosterEvent{}, false
+		}
+		delete(r.items, jid)
+		return RosterEvent{RosterItemRemoved, old}, true
+	}
+	item.JID = jid.Bare()
+	r.items[jid] = item
+	if !exists {
+		return RosterEvent{RosterItemAdded, item}, true
+	}
+	if rosterItemsEqual(old, item) {
+		return RosterEvent{}, false
+	}
+	return RosterEvent{RosterItemUpdated, item}, true
+}
+
+func rosterItemsEqual(a, b RosterItem) bool {
+	if a.JID != b.JID || a.Name != b.Name || a.Subscription != b.Subscription || a.Ask != b.Ask || a.Approved != b.Approved || len(a.Groups) != len(b.Groups) {
+		return false
+	}
+	for i := range a.Groups {
+		if a.Groups[i] != b.Groups[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply a roster push and acknowledge it.
+func (r *Roster) handlePush(iq *IQ) {
+	query := &RosterQuery{}
+	if err := iq.PayloadDecode(query); err != nil || len(query.Items) != 1 {
+		r.reply(iq.ErrorResponse(ErrorBadRequest, ""))
+		return
+	}
+	item := query.Items[0]
+	jid, err := ParseJID(item.JID)
+	if err != nil {
+		r.reply(iq.ErrorResponse(ErrorJIDMalformed, ""))
+		return
+	}
+	jid.Resource = ""
+
+	r.lock.Lock()
+	event, changed := r.update(jid, item)
+	if query.Ver != "" {
+		r.ver = query.Ver
+	}
+	r.lock.Unlock()
+
+	r.reply(iq.Response(IQTypeResult))
+	r.save()
+	if changed {
+		r.emit([]RosterEvent{event})
+	}
+}
+
+// Send the response to a roster push.
+func (r *Roster) reply(iq *IQ) {
+	if err := r.XMPP.Send(context.Background(), iq); err != nil && err != ErrStreamClosed {
+		log.Println("Error. Failed to answer roster push. ", err)
+	}
+}
+
+// Store the roster, if there is a store.
+func (r *Roster) save() {
+	if r.config.Store == nil {
+		return
+	}
+	r.lock.RLock()
+	ver, items := r.ver, r.list("")
+	r.lock.RUnlock()
+	if err := r.config.Store.Save(ver, items); err != nil {
+		log.Println("Error. Failed to save roster. ", err)
+	}
+}
+
+func (r *Roster) emit(events []RosterEvent) {
+	if r.config.OnChange == nil {
+		return
+	}
+	for _, event := range events {
+		r.config.OnChange(event)
+	}
+}
+
+// Return the roster version, "" if unknown.
+func (r *Roster) Version() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.ver
+}
+
+// Return all the roster items, ordered by JID.
+func (r *Roster) Items() []RosterItem {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.list("")
+}
+
+// Return the items in the group, ordered by JID.
+func (r *Roster) Group(group string) []RosterItem {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.list(group)
+}
+
+// Return the names of all the groups, sorted.
+func (r *Roster) Groups() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	seen := make(map[string]bool)
+	var groups []string
+	for _, item := range r.items {
+		for _, group := range item.Groups {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// Return the items, or the items in the group if not "", ordered by JID. Must
+// be called with the lock held.
+func (r *Roster) list(group string) []RosterItem {
+	items := make([]RosterItem, 0, len(r.items))
+	for _, item := range r.items {
+		if group == "" || containsString(item.Groups, group) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].JID < items[j].JID })
+	return items
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the item for the JID's bare JID, or false if it's not in the roster.
+func (r *Roster) Item(jid JID) (RosterItem, bool) {
+	jid = jid.normalise()
+	jid.Resource = ""
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	item, ok := r.items[jid]
+	return item, ok
+}
+
+// Add an item to the roster, or update it if it's already there. Only the
+// JID, name and groups are sent; the subscription state is managed by the
+// server. The roster itself is updated when the server pushes the change.
+func (r *Roster) Set(ctx context.Context, item RosterItem) error {
+	jid, err := ParseJID(item.JID)
+	if err != nil {
+		return err
+	}
+	req := RosterItem{JID: jid.Bare(), Name: item.Name, Groups: item.Groups}
+	_, err = Set[RosterQuery](ctx, r.XMPP, "", &RosterQuery{Items: []RosterItem{req}})
+	return err
+}
+
+// Remove the JID's bare JID from the roster. The server also cancels any
+// subscriptions. The roster itself is updated when the server pushes the
+// change.
+func (r *Roster) Remove(ctx context.Context, jid JID) error {
+	item := RosterItem{JID: jid.Bare(), Subscription: RosterSubscriptionRemove}
+	_, err := Set[RosterQuery](ctx, r.XMPP, "", &RosterQuery{Items: []RosterItem{item}})
+	return err
 }
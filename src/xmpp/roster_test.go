@@ -0,0 +1,150 @@
+package xmpp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRosterStore struct {
+	lock  sync.Mutex
+	ver   string
+	items []RosterItem
+}
+
+func (s *testRosterStore) Load() (string, []RosterItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ver, s.items, nil
+}
+
+func (s *testRosterStore) Save(ver string, items []RosterItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ver, s.items = ver, items
+	return nil
+}
+
+func TestRoster(t *testing.T) {
+	x, s := newTestXMPP(t)
+	events := make(chan RosterEvent, 10)
+	roster := NewRoster(x, &RosterConfig{OnChange: func(e RosterEvent) { events <- e }})
+	defer roster.Close()
+
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='result' id='"+req.ID+"'><query xmlns='jabber:iq:roster'>"+
+			"<item jid='Hatter@Wonderland.lit' name='Hatter' subscription='both'><group>Tea</group></item>"+
+			"<item jid='rabbit@wonderland.lit' subscription='none' ask='subscribe'/>"+
+			"</query></iq>")
+	}()
+	if err := roster.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Type != RosterItemAdded || e.Item.JID != "hatter@wonderland.lit" || e.Item.Groups[0] != "Tea" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e := <-events; e.Type != RosterItemAdded || e.Item.Ask != RosterAskSubscribe {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if items := roster.Items(); len(items) != 2 || items[0].Name != "Hatter" {
+		t.Errorf("unexpected items: %+v", items)
+	}
+	if groups := roster.Groups(); len(groups) != 1 || len(roster.Group("Tea")) != 1 {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	// Spoofed pushes are left for someone else.
+	s.send(t, "<iq type='set' id='p1' from='rabbit@wonderland.lit'><query xmlns='jabber:iq:roster'>"+
+		"<item jid='rabbit@wonderland.lit' subscription='remove'/></query></iq>")
+	select {
+	case v := <-x.In:
+		if iq, ok := v.(*IQ); !ok || iq.ID != "p1" {
+			t.Errorf("unexpected stanza: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("spoofed push not delivered")
+	}
+
+	s.send(t, "<iq type='set' id='p2'><query xmlns='jabber:iq:roster'>"+
+		"<item jid='rabbit@wonderland.lit' subscription='remove'/></query></iq>")
+	if resp := s.recvIQ(t); resp.Type != IQTypeResult || resp.ID != "p2" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	if e := <-events; e.Type != RosterItemRemoved || e.Item.JID != "rabbit@wonderland.lit" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if _, ok := roster.Item(MustParseJID("Rabbit@wonderland.lit/watch")); ok {
+		t.Error("item not removed")
+	}
+	if _, ok := roster.Item(MustParseJID("hatter@wonderland.lit")); !ok {
+		t.Error("item missing")
+	}
+}
+
+func TestRosterSetRemove(t *testing.T) {
+	x, s := newTestXMPP(t)
+	roster := NewRoster(x, nil)
+	defer roster.Close()
+
+	go func() {
+		req := s.recvIQ(t)
+		query := &RosterQuery{}
+		req.PayloadDecode(query)
+		if req.Type != IQTypeSet || len(query.Items) != 1 || query.Items[0].JID != "hatter@wonderland.lit" ||
+			query.Items[0].Subscription != "" || len(query.Items[0].Groups) != 2 {
+			t.Errorf("unexpected request: %+v", query)
+		}
+		s.send(t, "<iq type='result' id='"+req.ID+"'/>")
+
+		req = s.recvIQ(t)
+		query = &RosterQuery{}
+		req.PayloadDecode(query)
+		if len(query.Items) != 1 || query.Items[0].Subscription != RosterSubscriptionRemove {
+			t.Errorf("unexpected request: %+v", query)
+		}
+		s.send(t, "<iq type='result' id='"+req.ID+"'/>")
+	}()
+
+	item := RosterItem{JID: "hatter@wonderland.lit/tea", Subscription: RosterSubscriptionBoth, Groups: []string{"Tea", "Party"}}
+	if err := roster.Set(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	if err := roster.Remove(context.Background(), MustParseJID("hatter@wonderland.lit")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRosterVersioning(t *testing.T) {
+	x, s := newTestXMPP(t)
+	x.features = &features{RosterVer: &rosterVer{}}
+	store := &testRosterStore{ver: "v1", items: []RosterItem{{JID: "hatter@wonderland.lit", Subscription: RosterSubscriptionBoth}}}
+	roster := NewRoster(x, &RosterConfig{Store: store})
+	defer roster.Close()
+
+	go func() {
+		req := s.recvIQ(t)
+		query := &RosterQuery{}
+		req.PayloadDecode(query)
+		if query.Ver != "v1" {
+			t.Errorf("unexpected version: %q", query.Ver)
+		}
+		s.send(t, "<iq type='result' id='"+req.ID+"'/>")
+	}()
+	if err := roster.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(roster.Items()) != 1 {
+		t.Errorf("stored roster not used: %+v", roster.Items())
+	}
+
+	s.send(t, "<iq type='set' id='p1'><query xmlns='jabber:iq:roster' ver='v2'>"+
+		"<item jid='rabbit@wonderland.lit' subscription='to'/></query></iq>")
+	s.recvIQ(t)
+	waitFor(t, "roster version v2", func() bool { return roster.Version() == "v2" })
+	waitFor(t, "stored roster v2", func() bool {
+		ver, items, _ := store.Load()
+		return ver == "v2" && len(items) == 2
+	})
+}
@@ -24,6 +24,7 @@ type IQ struct {
 	Type    string   `xml:"type,attr"`
 	To      string   `xml:"to,attr,omitempty"`
 	From    string   `xml:"from,attr,omitempty"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 	Payload string   `xml:",innerxml"`
 	Error   *Error   `xml:"error"`
 }
@@ -48,12 +49,8 @@ func (iq *IQ) PayloadDecode(v interface{}) error {
 // Return the name of the payload element.
 func (iq *IQ) PayloadName() (name xml.Name) {
 	dec := xml.NewDecoder(bytes.NewBufferString(iq.Payload))
-	tok, err := dec.Token()
-	if err != nil {
-		return
-	}
-	start, ok := tok.(xml.StartElement)
-	if !ok {
+	start := startElementIter(dec)()
+	if start == nil {
 		return
 	}
 	return start.Name
@@ -65,18 +62,30 @@ func (iq *IQ) Response(iqType string) *IQ {
 	return &IQ{ID: iq.ID, Type: iqType, From: iq.To, To: iq.From}
 }
 
+// Return the 'to' address as a JID. The zero JID is returned if there is no
+// address.
+func (iq *IQ) ToJID() (JID, error) {
+	return parseAddress(iq.To)
+}
+
+// Return the 'from' address as a JID. The zero JID is returned if there is no
+// address.
+func (iq *IQ) FromJID() (JID, error) {
+	return parseAddress(iq.From)
+}
+
 // XMPP <message/> stanza.
 type Message struct {
-	XMLName xml.Name      `xml:"message"`
-	ID      string        `xml:"id,attr,omitempty"`
-	Type    string        `xml:"type,attr,omitempty"`
-	To      string        `xml:"to,attr,omitempty"`
-	From    string        `xml:"from,attr,omitempty"`
-	Subject string        `xml:"subject,omitempty"`
-	Body    []MessageBody `xml:"body,omitempty"`
-	Thread  string        `xml:"thread,omitempty"`
-	Error   *Error        `xml:"error"`
-	Lang    string        `xml:"xml:lang,attr,omitempty"`
+	XMLName xml.Name         `xml:"message"`
+	ID      string           `xml:"id,attr,omitempty"`
+	Type    string           `xml:"type,attr,omitempty"`
+	To      string           `xml:"to,attr,omitempty"`
+	From    string           `xml:"from,attr,omitempty"`
+	Subject []MessageSubject `xml:"subject,omitempty"`
+	Body    []MessageBody    `xml:"body,omitempty"`
+	Thread  string           `xml:"thread,omitempty"`
+	Error   *Error           `xml:"error"`
+	Lang    string           `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 
 	Confirm *Confirm `xml:"confirm"` // XEP-0070
 
@@ -85,24 +94,89 @@ type Message struct {
 	Paused    *Paused    `xml:"paused"`    // XEP-0085
 	Inactive  *Inactive  `xml:"inactive"`  // XEP-0085
 	Gone      *Gone      `xml:"gone"`      // XEP-0085
+
+	// Children not decoded into the fields above.
+	Extensions Extensions `xml:",any"`
 }
 
 type MessageBody struct {
-	Lang  string `xml:"xml:lang,attr,omitempty"`
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type MessageSubject struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 	Value string `xml:",chardata"`
 }
 
+// Return the body in the most preferred of the languages, see
+// SelectLanguage. Returns "" if there is no body.
+func (msg *Message) BodyFor(langs ...string) string {
+	i := SelectLanguage(len(msg.Body), func(i int) string { return msg.Body[i].Lang }, msg.Lang, langs)
+	if i < 0 {
+		return ""
+	}
+	return msg.Body[i].Value
+}
+
+// Return the subject in the most preferred of the languages, see
+// SelectLanguage. Returns "" if there is no subject.
+func (msg *Message) SubjectFor(langs ...string) string {
+	i := SelectLanguage(len(msg.Subject), func(i int) string { return msg.Subject[i].Lang }, msg.Lang, langs)
+	if i < 0 {
+		return ""
+	}
+	return msg.Subject[i].Value
+}
+
+// Return the 'to' address as a JID. The zero JID is returned if there is no
+// address.
+func (msg *Message) ToJID() (JID, error) {
+	return parseAddress(msg.To)
+}
+
+// Return the 'from' address as a JID. The zero JID is returned if there is no
+// address.
+func (msg *Message) FromJID() (JID, error) {
+	return parseAddress(msg.From)
+}
+
 // XMPP <presence/> stanza.
 type Presence struct {
-	XMLName xml.Name `xml:"presence"`
-	ID      string   `xml:"id,attr,omitempty"`
-	Type    string   `xml:"type,attr,omitempty"`
-	To      string   `xml:"to,attr,omitempty"`
-	From    string   `xml:"from,attr,omitempty"`
-	Show    string   `xml:"show"`            // away, chat, dnd, xa
-	Status  string   `xml:"status"`          // sb []clientText
-	Photo   string   `xml:"photo,omitempty"` // Avatar
-	Nick    string   `xml:"nick,omitempty"`  // Nickname
+	XMLName  xml.Name         `xml:"presence"`
+	ID       string           `xml:"id,attr,omitempty"`
+	Type     PresenceType     `xml:"type,attr,omitempty"`
+	To       string           `xml:"to,attr,omitempty"`
+	From     string           `xml:"from,attr,omitempty"`
+	Lang     string           `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Show     PresenceShow     `xml:"show,omitempty"`
+	Status   []PresenceStatus `xml:"status,omitempty"`
+	Priority PresencePriority `xml:"priority,omitempty"`
+	Error    *Error           `xml:"error"`
+
+	VCardUpdate *VCardUpdate `xml:"vcard-temp:x:update x"`                // XEP-0153
+	Nick        *Nick        `xml:"http://jabber.org/protocol/nick nick"` // XEP-0172
+
+	// Children not decoded into the fields above.
+	Extensions Extensions `xml:",any"`
+}
+
+// Return the 'to' address as a JID. The zero JID is returned if there is no
+// address.
+func (presence *Presence) ToJID() (JID, error) {
+	return parseAddress(presence.To)
+}
+
+// Return the 'from' address as a JID. The zero JID is returned if there is no
+// address.
+func (presence *Presence) FromJID() (JID, error) {
+	return parseAddress(presence.From)
+}
+
+// Parse a stanza's address, which may be empty.
+func parseAddress(addr string) (jid JID, err error) {
+	err = jid.UnmarshalText([]byte(addr))
+	return
 }
 
 // XMPP <error/>. May occur as a top-level stanza or embedded in another
@@ -111,6 +185,7 @@ type Error struct {
 	XMLName xml.Name `xml:"error"`
 	Code    string   `xml:"code,attr,omitempty"`
 	Type    string   `xml:"type,attr"`
+	By      string   `xml:"by,attr,omitempty"`
 	Payload string   `xml:",innerxml"`
 }
 
@@ -127,18 +202,19 @@ type errorText struct {
 	Text    string `xml:",chardata"`
 }
 
-// Create a new Error instance using the args as the payload.
+// Create a new Error instance using the args as the payload. The condition's
+// default type is used if errorType is "".
 func NewError(errorType string, condition ErrorCondition, text string) *Error {
 
+	if errorType == "" {
+		errorType = condition.DefaultType()
+	}
+
 	// Build payload.
 	buf := new(bytes.Buffer)
-	writeXMLStartElement(buf, &xml.StartElement{
-		Name: xml.Name{"", condition.Local},
-		Attr: []xml.Attr{
-			{xml.Name{"", "xmlns"}, condition.Space},
-		},
-	})
-	writeXMLEndElement(buf, &xml.EndElement{Name: xml.Name{"", condition.Local}})
+	xw := newXMLWriter(buf)
+	xw.StartElement(xml.StartElement{Name: xml.Name(condition)})
+	xw.EndElement(xml.EndElement{Name: xml.Name(condition)})
 	enc := xml.NewEncoder(buf)
 	if text != "" {
 		enc.Encode(errorText{xml.Name{condition.Space, "text"}, text})
@@ -183,16 +259,166 @@ func (e Error) Condition() ErrorCondition {
 	return ErrorCondition{}
 }
 
-// Error condition.
+// Return the application-specific condition element from the payload, or nil
+// if there is none.
+func (e Error) AppCondition() *Extension {
+	dec := xml.NewDecoder(bytes.NewBufferString(e.Payload))
+	next := startElementIter(dec)
+	for start := next(); start != nil; {
+		if start.Name.Space != nsErrorStanzas && start.Name.Space != nsErrorStreams {
+			ext := &Extension{}
+			if err := dec.DecodeElement(ext, start); err != nil {
+				return nil
+			}
+			return ext
+		}
+		dec.Skip()
+		start = next()
+	}
+	return nil
+}
+
+// Add an application-specific condition element, encoded from v, to the
+// payload. See xml.Marshal for how the value is encoded.
+func (e *Error) SetAppCondition(v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.Payload += string(b)
+	return nil
+}
+
+// Report whether the error matches target, allowing errors.Is to test for a
+// condition, e.g. errors.Is(err, ErrorItemNotFound). An ErrorCondition
+// target matches the defined condition or, for a condition outside the stanza
+// errors namespace, the application-specific condition's element name.
+func (e Error) Is(target error) bool {
+	condition, ok := target.(ErrorCondition)
+	if !ok {
+		return false
+	}
+	if condition.Space == nsErrorStanzas || condition.Space == nsErrorStreams {
+		return e.Condition() == condition
+	}
+	app := e.AppCondition()
+	return app != nil && app.XMLName == xml.Name(condition)
+}
+
+// Create an error response to the request. The ID is kept, To and From are
+// reversed and the original payload is included. The condition's default
+// error type is used.
+func (iq *IQ) ErrorResponse(condition ErrorCondition, text string) *IQ {
+	resp := iq.Response(IQTypeError)
+	resp.Payload = iq.Payload
+	resp.Error = NewError("", condition, text)
+	return resp
+}
+
+// Create an error response to the message, i.e. bounce it. The original
+// content is included, To and From are reversed and the condition's default
+// error type is used.
+func (msg *Message) ErrorResponse(condition ErrorCondition, text string) *Message {
+	resp := *msg
+	resp.XMLName = xml.Name{}
+	resp.Type = MessageTypeError
+	resp.To, resp.From = msg.From, msg.To
+	resp.Subject = append([]MessageSubject(nil), msg.Subject...)
+	resp.Body = append([]MessageBody(nil), msg.Body...)
+	resp.Extensions = append(Extensions(nil), msg.Extensions...)
+	resp.Error = NewError("", condition, text)
+	return &resp
+}
+
+// Create an error response to the presence. The original content is
+// included, To and From are reversed and the condition's default error type
+// is used.
+func (presence *Presence) ErrorResponse(condition ErrorCondition, text string) *Presence {
+	resp := *presence
+	resp.XMLName = xml.Name{}
+	resp.Type = PresenceTypeError
+	resp.To, resp.From = presence.From, presence.To
+	resp.Status = append([]PresenceStatus(nil), presence.Status...)
+	resp.Extensions = append(Extensions(nil), presence.Extensions...)
+	resp.Error = NewError("", condition, text)
+	return &resp
+}
+
+// Error condition. Stanza and stream errors have one of the conditions
+// defined by RFC 6120; an application-specific condition is any element name
+// in another namespace. Implements error so a condition can be used as the
+// target of errors.Is.
 type ErrorCondition xml.Name
 
+func (c ErrorCondition) Error() string {
+	return c.Local
+}
+
+// Return the error type usually associated with the condition, as suggested
+// by RFC 6120 section 8.3.3. Returns ErrorTypeCancel for unknown conditions.
+func (c ErrorCondition) DefaultType() string {
+	if errorType, ok := defaultErrorTypes[c]; ok {
+		return errorType
+	}
+	return ErrorTypeCancel
+}
+
+// Stanza error types.
+const (
+	ErrorTypeAuth     = "auth"
+	ErrorTypeCancel   = "cancel"
+	ErrorTypeContinue = "continue"
+	ErrorTypeModify   = "modify"
+	ErrorTypeWait     = "wait"
+)
+
 // Stanza errors.
 var (
+	ErrorBadRequest            = ErrorCondition{nsErrorStanzas, "bad-request"}
+	ErrorConflict              = ErrorCondition{nsErrorStanzas, "conflict"}
 	ErrorFeatureNotImplemented = ErrorCondition{nsErrorStanzas, "feature-not-implemented"}
+	ErrorForbidden             = ErrorCondition{nsErrorStanzas, "forbidden"}
+	ErrorGone                  = ErrorCondition{nsErrorStanzas, "gone"}
+	ErrorInternalServerError   = ErrorCondition{nsErrorStanzas, "internal-server-error"}
+	ErrorItemNotFound          = ErrorCondition{nsErrorStanzas, "item-not-found"}
+	ErrorJIDMalformed          = ErrorCondition{nsErrorStanzas, "jid-malformed"}
+	ErrorNotAcceptable         = ErrorCondition{nsErrorStanzas, "not-acceptable"}
+	ErrorNotAllowed            = ErrorCondition{nsErrorStanzas, "not-allowed"}
+	ErrorNotAuthorized         = ErrorCondition{nsErrorStanzas, "not-authorized"}
+	ErrorPolicyViolation       = ErrorCondition{nsErrorStanzas, "policy-violation"}
+	ErrorRecipientUnavailable  = ErrorCondition{nsErrorStanzas, "recipient-unavailable"}
+	ErrorRedirect              = ErrorCondition{nsErrorStanzas, "redirect"}
+	ErrorRegistrationRequired  = ErrorCondition{nsErrorStanzas, "registration-required"}
 	ErrorRemoteServerNotFound  = ErrorCondition{nsErrorStanzas, "remote-server-not-found"}
+	ErrorRemoteServerTimeout   = ErrorCondition{nsErrorStanzas, "remote-server-timeout"}
+	ErrorResourceConstraint    = ErrorCondition{nsErrorStanzas, "resource-constraint"}
 	ErrorServiceUnavailable    = ErrorCondition{nsErrorStanzas, "service-unavailable"}
-	ErrorNotAuthorized         = ErrorCondition{nsErrorStanzas, "not-authorized"}
-	ErrorConflict              = ErrorCondition{nsErrorStanzas, "conflict"}
-	ErrorNotAcceptable         = ErrorCondition{nsErrorStanzas, "not-acceptable"}
-	ErrorForbidden             = ErrorCondition{nsErrorStanzas, "forbidden"}
+	ErrorSubscriptionRequired  = ErrorCondition{nsErrorStanzas, "subscription-required"}
+	ErrorUndefinedCondition    = ErrorCondition{nsErrorStanzas, "undefined-condition"}
+	ErrorUnexpectedRequest     = ErrorCondition{nsErrorStanzas, "unexpected-request"}
 )
+
+var defaultErrorTypes = map[ErrorCondition]string{
+	ErrorBadRequest:            ErrorTypeModify,
+	ErrorConflict:              ErrorTypeCancel,
+	ErrorFeatureNotImplemented: ErrorTypeCancel,
+	ErrorForbidden:             ErrorTypeAuth,
+	ErrorGone:                  ErrorTypeCancel,
+	ErrorInternalServerError:   ErrorTypeCancel,
+	ErrorItemNotFound:          ErrorTypeCancel,
+	ErrorJIDMalformed:          ErrorTypeModify,
+	ErrorNotAcceptable:         ErrorTypeModify,
+	ErrorNotAllowed:            ErrorTypeCancel,
+	ErrorNotAuthorized:         ErrorTypeAuth,
+	ErrorPolicyViolation:       ErrorTypeModify,
+	ErrorRecipientUnavailable:  ErrorTypeWait,
+	ErrorRedirect:              ErrorTypeModify,
+	ErrorRegistrationRequired:  ErrorTypeAuth,
+	ErrorRemoteServerNotFound:  ErrorTypeCancel,
+	ErrorRemoteServerTimeout:   ErrorTypeWait,
+	ErrorResourceConstraint:    ErrorTypeWait,
+	ErrorServiceUnavailable:    ErrorTypeCancel,
+	ErrorSubscriptionRequired:  ErrorTypeAuth,
+	ErrorUndefinedCondition:    ErrorTypeCancel,
+	ErrorUnexpectedRequest:     ErrorTypeWait,
+}
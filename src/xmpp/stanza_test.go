@@ -0,0 +1,97 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testAppCondition struct {
+	XMLName xml.Name `xml:"urn:example:errors too-many"`
+	Limit   string   `xml:"limit,attr"`
+}
+
+func TestErrorIs(t *testing.T) {
+	in := "<iq type='error' id='1' xmlns='jabber:client'><error type='wait' by='wonderland.lit'>" +
+		"<resource-constraint xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>" +
+		"<too-many xmlns='urn:example:errors' limit='10'/>" +
+		"<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>Slow down</text>" +
+		"</error></iq>"
+	iq := &IQ{}
+	if err := xml.Unmarshal([]byte(in), iq); err != nil {
+		t.Fatal(err)
+	}
+	if iq.Error.By != "wonderland.lit" || iq.Error.Text() != "Slow down" {
+		t.Errorf("unexpected error: %+v", iq.Error)
+	}
+
+	var err error = newIQError(iq)
+	if !errors.Is(err, ErrorResourceConstraint) {
+		t.Error("expected resource-constraint")
+	}
+	if errors.Is(err, ErrorItemNotFound) {
+		t.Error("unexpected item-not-found")
+	}
+	app := ErrorCondition{"urn:example:errors", "too-many"}
+	if !errors.Is(err, app) {
+		t.Error("expected application-specific condition")
+	}
+	cond := &testAppCondition{}
+	if ext := iq.Error.AppCondition(); ext == nil || ext.Decode(cond) != nil || cond.Limit != "10" {
+		t.Errorf("unexpected application-specific condition: %+v", ext)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	e := NewError("", ErrorItemNotFound, "")
+	if e.Type != ErrorTypeCancel || e.Condition() != ErrorItemNotFound {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	if NewError("", ErrorNotAuthorized, "").Type != ErrorTypeAuth {
+		t.Error("expected auth error type")
+	}
+	if err := e.SetAppCondition(&testAppCondition{Limit: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Is(ErrorCondition{"urn:example:errors", "too-many"}) || !e.Is(ErrorItemNotFound) {
+		t.Errorf("unexpected conditions: %s", e.Payload)
+	}
+}
+
+func TestIQErrorResponse(t *testing.T) {
+	req := &IQ{ID: "1", Type: IQTypeGet, From: "alice@wonderland.lit/a", To: "wonderland.lit", Payload: "<query xmlns='jabber:iq:version'/>"}
+	resp := req.ErrorResponse(ErrorServiceUnavailable, "Not here")
+	if resp.ID != "1" || resp.Type != IQTypeError || resp.To != req.From || resp.From != req.To {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	b, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &IQ{}
+	if err := xml.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PayloadName().Space != "jabber:iq:version" || !errors.Is(decoded.Error, ErrorServiceUnavailable) || decoded.Error.Type != ErrorTypeCancel {
+		t.Errorf("unexpected response: %s", b)
+	}
+}
+
+func TestMessageErrorResponse(t *testing.T) {
+	msg := &Message{ID: "1", Type: MessageTypeChat, From: "alice@wonderland.lit/a", To: "bob@wonderland.lit", Body: []MessageBody{{Value: "Hi"}}}
+	resp := msg.ErrorResponse(ErrorRecipientUnavailable, "")
+	if resp.Type != MessageTypeError || resp.To != msg.From || resp.From != msg.To || resp.Body[0].Value != "Hi" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if msg.Type != MessageTypeChat || msg.Error != nil {
+		t.Error("original message modified")
+	}
+	b, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `<error type="wait"><recipient-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>`) {
+		t.Errorf("unexpected xml: %s", b)
+	}
+}
@@ -0,0 +1,227 @@
+package xmpp
+
+import (
+	"sync"
+)
+
+// Handles an incoming stanza, typically a *Message or *Presence.
+type StanzaHandler interface {
+	HandleStanza(x *XMPP, v interface{})
+}
+
+// Adapter to allow a plain func to be used as a StanzaHandler.
+type StanzaHandlerFunc func(x *XMPP, v interface{})
+
+// Implement StanzaHandler by calling the adapted func.
+func (fn StanzaHandlerFunc) HandleStanza(x *XMPP, v interface{}) {
+	fn(x, v)
+}
+
+// Wraps a StanzaHandler to add behaviour, e.g. logging, rate limiting or
+// authorisation checks, before and/or after the stanza is handled. A
+// middleware may also decide not to call the wrapped handler at all.
+type Middleware func(next StanzaHandler) StanzaHandler
+
+// Stanza multiplexer. Routes incoming stanzas to the handler of the first
+// route, in registration order, that matches the stanza. The mux's
+// middleware is applied to every stanza, whether it's routed or not.
+type StanzaMux struct {
+	// Handler for stanzas that match no route. Unrouted stanzas are dropped
+	// if nil.
+	NotFound StanzaHandler
+
+	lock       sync.RWMutex
+	routes     []stanzaRoute
+	middleware []Middleware
+}
+
+type stanzaRoute struct {
+	m Matcher
+	h StanzaHandler
+}
+
+// Create a new, empty StanzaMux.
+func NewStanzaMux() *StanzaMux {
+	return &StanzaMux{}
+}
+
+// Add middleware to the mux. Middleware is applied in the order it's added,
+// i.e. the first middleware added sees the stanza first.
+func (mux *StanzaMux) Use(mw ...Middleware) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	mux.middleware = append(mux.middleware, mw...)
+}
+
+// Register the handler for stanzas that match m. Route is a convenient
+// Matcher for the common cases.
+func (mux *StanzaMux) Handle(m Matcher, h StanzaHandler) {
+	if r, ok := m.(Route); ok {
+		m = r.matcher()
+	}
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	mux.routes = append(mux.routes, stanzaRoute{m, h})
+}
+
+// Register the handler func for stanzas that match m.
+func (mux *StanzaMux) HandleFunc(m Matcher, fn func(x *XMPP, v interface{})) {
+	mux.Handle(m, StanzaHandlerFunc(fn))
+}
+
+// Return the handler for the stanza, or nil if there is no handler.
+func (mux *StanzaMux) Handler(v interface{}) StanzaHandler {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+	for _, route := range mux.routes {
+		if route.m.Match(v) {
+			return route.h
+		}
+	}
+	return mux.NotFound
+}
+
+// Pass the stanza through the middleware and on to its handler. Implements
+// StanzaHandler so muxes can be nested.
+func (mux *StanzaMux) HandleStanza(x *XMPP, v interface{}) {
+	mux.lock.RLock()
+	var h StanzaHandler = StanzaHandlerFunc(mux.route)
+	for i := len(mux.middleware) - 1; i >= 0; i-- {
+		h = mux.middleware[i](h)
+	}
+	mux.lock.RUnlock()
+	h.HandleStanza(x, v)
+}
+
+func (mux *StanzaMux) route(x *XMPP, v interface{}) {
+	if h := mux.Handler(v); h != nil {
+		h.HandleStanza(x, v)
+	}
+}
+
+// Start routing stanzas received by x that match m (all messages and
+// presences if m is nil) to the registered handlers, until the stream closes
+// or the returned stop func is called. Stanzas are handled one at a time, in
+// the order they are received.
+func (mux *StanzaMux) Serve(x *XMPP, m Matcher) (stop func() error) {
+	if m == nil {
+		m = Or(StanzaKind("message"), StanzaKind("presence"))
+	} else if r, ok := m.(Route); ok {
+		m = r.matcher()
+	}
+	fid, ch := x.AddFilter(m)
+	go func() {
+		for v := range ch {
+			mux.HandleStanza(x, v)
+		}
+	}()
+	return func() error {
+		return x.RemoveFilter(fid)
+	}
+}
+
+// Matcher for the common routing criteria. Zero-value fields match anything;
+// all the criteria that are set must match.
+type Route struct {
+	// Stanza element name, e.g. "message" or "presence".
+	Kind string
+
+	// Stanza type attribute. A message with no type is treated as
+	// MessageTypeNormal.
+	Type string
+
+	// Sender. A bare JID matches the bare JID and any of its resources, a
+	// full JID only matches exactly.
+	From string
+
+	// Message thread id.
+	Thread string
+
+	// Namespace of one of the stanza's child elements, e.g.
+	// NSChatStatesNotification.
+	Namespace string
+}
+
+// Implement Matcher. Handle prepares a Route once, when it's registered,
+// rather than for every stanza.
+func (r Route) Match(v interface{}) bool {
+	return r.matcher().Match(v)
+}
+
+// Route prepared for matching, with the sender already parsed.
+type routeMatcher struct {
+	Route
+
+	// Parsed sender, nil if the route has none, and whether it's a full JID.
+	from     *JID
+	fromFull bool
+
+	// Set if the sender can't be parsed, so nothing matches.
+	invalid bool
+}
+
+func (r Route) matcher() *routeMatcher {
+	m := &routeMatcher{Route: r}
+	if r.From != "" {
+		from, err := ParseJID(r.From)
+		if err != nil {
+			m.invalid = true
+			return m
+		}
+		m.from = &from
+		m.fromFull = from.Resource != ""
+	}
+	return m
+}
+
+// Implement Matcher.
+func (m *routeMatcher) Match(v interface{}) bool {
+	if m.invalid {
+		return false
+	}
+
+	var kind, stanzaType, from, thread string
+	switch v := v.(type) {
+	case *Message:
+		kind, stanzaType, from, thread = "message", v.Type, v.From, v.Thread
+		if stanzaType == "" {
+			stanzaType = MessageTypeNormal
+		}
+	case *Presence:
+		kind, stanzaType, from = "presence", string(v.Type), v.From
+	case *IQ:
+		kind, stanzaType, from = "iq", v.Type, v.From
+	default:
+		return false
+	}
+
+	if m.Kind != "" && m.Kind != kind {
+		return false
+	}
+	if m.Type != "" && m.Type != stanzaType {
+		return false
+	}
+	if m.Thread != "" && m.Thread != thread {
+		return false
+	}
+	if m.from != nil && !m.matchFrom(from) {
+		return false
+	}
+	if m.Namespace != "" && !hasChildNamespace(v, m.Namespace) {
+		return false
+	}
+	return true
+}
+
+// Test if the stanza's sender matches the route's. A bare JID matches any of
+// its resources.
+func (m *routeMatcher) matchFrom(from string) bool {
+	fromJID, err := ParseJID(from)
+	if err != nil {
+		return false
+	}
+	if m.fromFull {
+		return fromJID.Full() == m.from.Full()
+	}
+	return fromJID.Bare() == m.from.Bare()
+}
@@ -0,0 +1,100 @@
+package xmpp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRouteMatch(t *testing.T) {
+	msg := &Message{Type: MessageTypeChat, From: "bob@wonderland.lit/phone", Thread: "t1", Composing: &Composing{}}
+	tests := []struct {
+		route Route
+		match bool
+	}{
+		{Route{}, true},
+		{Route{Kind: "message"}, true},
+		{Route{Kind: "presence"}, false},
+		{Route{Type: MessageTypeChat}, true},
+		{Route{Type: MessageTypeNormal}, false},
+		{Route{From: "bob@wonderland.lit"}, true},
+		{Route{From: "bob@wonderland.lit/phone"}, true},
+		{Route{From: "bob@wonderland.lit/laptop"}, false},
+		{Route{Thread: "t1"}, true},
+		{Route{Thread: "t2"}, false},
+		{Route{Namespace: NSChatStatesNotification}, true},
+		{Route{Namespace: NSHTTPAuth}, false},
+	}
+	for _, test := range tests {
+		if test.route.Match(msg) != test.match {
+			t.Errorf("%+v: expected match %v", test.route, test.match)
+		}
+	}
+	if !(Route{Type: MessageTypeNormal}).Match(&Message{}) {
+		t.Errorf("message with no type should be normal")
+	}
+}
+
+func TestStanzaMux(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next StanzaHandler) StanzaHandler {
+			return StanzaHandlerFunc(func(x *XMPP, v interface{}) {
+				calls = append(calls, name)
+				next.HandleStanza(x, v)
+			})
+		}
+	}
+
+	mux := NewStanzaMux()
+	mux.Use(mw("first"), mw("second"))
+	mux.HandleFunc(Route{Kind: "message"}, func(x *XMPP, v interface{}) {
+		calls = append(calls, "message")
+	})
+	mux.NotFound = StanzaHandlerFunc(func(x *XMPP, v interface{}) {
+		calls = append(calls, "not found")
+	})
+
+	mux.HandleStanza(nil, &Message{})
+	mux.HandleStanza(nil, &Presence{})
+
+	expected := []string{"first", "second", "message", "first", "second", "not found"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestStanzaMuxServe(t *testing.T) {
+	x, s := newTestXMPP(t)
+
+	handled := make(chan interface{}, 1)
+	mux := NewStanzaMux()
+	mux.HandleFunc(Route{Kind: "message"}, func(x *XMPP, v interface{}) {
+		handled <- v
+	})
+	stop := mux.Serve(x, nil)
+
+	go s.send(t, "<message from='hatter@wonderland.lit/tea' id='1'/>")
+	select {
+	case v := <-handled:
+		if msg, ok := v.(*Message); !ok || msg.ID != "1" {
+			t.Errorf("unexpected stanza: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+
+	// Stanzas are left for the In channel once the mux is stopped.
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	go s.send(t, "<message from='hatter@wonderland.lit/tea' id='2'/>")
+	select {
+	case v := <-x.In:
+		if msg, ok := v.(*Message); !ok || msg.ID != "2" {
+			t.Errorf("unexpected stanza: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
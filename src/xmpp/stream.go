@@ -1,33 +1,123 @@
 package xmpp
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Stream configuration.
 type StreamConfig struct {
 	// Log all sent and received stanzas.
-	// Enabling this option causes stanzas to be buffered in memory before they
-	// are either sent to the server or delivered to the application. It also
-	// causes incoming stanzas to be XML-parsed a second time.
 	LogStanzas bool
 
+	// Receives a copy of the raw data of every incoming top-level element,
+	// e.g. for recording or hashing, with one Write per element. The data is
+	// exactly what was received so it may depend on namespace prefixes
+	// declared by the stream's start element.
+	RecvTee io.Writer
+
 	// The dommain connection for certificate validation.
 	ConnectionDomain string
+
+	// Time to wait for the remote end to close its stream when the XMPP
+	// conversation is closed. Defaults to DefaultCloseTimeout.
+	CloseTimeout time.Duration
+
+	// Outgoing stanza queue configuration, e.g. rate limiting. See
+	// QueueConfig for the defaults used if nil.
+	Queue *QueueConfig
+
+	// Limits on incoming data, protecting against peers that try to exhaust
+	// memory. Exceeding a limit terminates the stream with a
+	// policy-violation stream error. Zero means the default limit, a
+	// negative value means no limit.
+	//
+	// Regardless of the limits, restricted XML (RFC 6120 section 11.1), i.e.
+	// comments, processing instructions, DTDs and entity references other
+	// than the predefined entities, terminates the stream with a
+	// restricted-xml stream error.
+
+	// Maximum size, in bytes, of a top-level element. Defaults to
+	// DefaultMaxStanzaBytes.
+	MaxStanzaBytes int64
+
+	// Maximum depth of nested elements, counting the top-level element as
+	// depth 1. Defaults to DefaultMaxDepth.
+	MaxDepth int
+
+	// Maximum number of attributes an element may have, including namespace
+	// declarations. Defaults to DefaultMaxAttributes.
+	MaxAttributes int
 }
 
+// Size of the buffer used for writing to the net connection.
+const writeBufferSize = 16 * 1024
+
 type Stream struct {
-	conn              net.Conn
-	dec               *xml.Decoder
-	config            *StreamConfig
-	stanzaBuf         string
-	incomingNamespace nsMap
+	conn   net.Conn
+	dec    *xml.Decoder
+	config *StreamConfig
+
+	// Reader for the net connection, recording the raw incoming data and
+	// enforcing the limits. The offset of the start of the element currently
+	// being read is stanzaStart.
+	r           *recordingReader
+	stanzaStart int64
+
+	// Buffered writer for the net connection. Stanzas are encoded into encBuf
+	// by enc, which is reused for all stanzas, before being copied to w.
+	// ended is set once the closing tag has been written. wlock guards all
+	// writing.
+	wlock  sync.Mutex
+	w      *bufio.Writer
+	enc    *xml.Encoder
+	encBuf bytes.Buffer
+	ended  bool
+
+	// Writer for the stream's own start and end tags, remembering the
+	// prefixes bound by the start tag. Writes to tagBuf.
+	tags   *xmlWriter
+	tagBuf bytes.Buffer
+
+	// Default languages of the stanzas sent and received, set when the
+	// stream is started.
+	sendLang string
+	recvLang string
+}
+
+func newStream(conn net.Conn, config *StreamConfig) *Stream {
+	stream := &Stream{
+		conn:   conn,
+		config: config,
+		w:      bufio.NewWriterSize(conn, writeBufferSize),
+	}
+	stream.resetReader()
+	stream.enc = xml.NewEncoder(&stream.encBuf)
+	return stream
+}
+
+// Start reading the net connection with a new reader and decoder.
+func (stream *Stream) resetReader() {
+	record := stream.config.LogStanzas || stream.config.RecvTee != nil
+	stream.r = newRecordingReader(stream.conn, record, newXMLLimiter(stream.config))
+	stream.resetDecoder()
+}
+
+// Start reading a new XML document from the net connection.
+func (stream *Stream) resetDecoder() {
+	stream.r.reset()
+	stream.dec = xml.NewDecoder(stream.r)
+	stream.stanzaStart = 0
 }
 
 // Create a XML stream connection. A Stream is used by an XMPP instance to
@@ -45,7 +135,7 @@ func NewStream(addr string, config *StreamConfig) (*Stream, error) {
 		return nil, err
 	}
 
-	stream := &Stream{conn: conn, dec: xml.NewDecoder(conn), config: config}
+	stream := newStream(conn, config)
 	if config.ConnectionDomain == "" {
 		config.ConnectionDomain = strings.SplitN(addr, ":", 2)[0]
 	}
@@ -60,13 +150,18 @@ func NewStream(addr string, config *StreamConfig) (*Stream, error) {
 // Upgrade the stream's underlying net connection to TLS.
 func (stream *Stream) UpgradeTLS(config *tls.Config) error {
 
+	if err := stream.Flush(); err != nil {
+		return err
+	}
+
 	conn := tls.Client(stream.conn, config)
 	if err := conn.Handshake(); err != nil {
 		return err
 	}
 
 	stream.conn = conn
-	stream.dec = xml.NewDecoder(stream.conn)
+	stream.resetReader()
+	stream.w.Reset(stream.conn)
 
 	return nil
 }
@@ -75,63 +170,166 @@ func (stream *Stream) UpgradeTLS(config *tls.Config) error {
 func (stream *Stream) SendStart(start *xml.StartElement) (*xml.StartElement, error) {
 
 	// Write start of outgoing doc.
-	buf := new(bytes.Buffer)
-	if err := writeXMLStartElement(buf, start); err != nil {
-		return nil, err
+	stream.wlock.Lock()
+	stream.ended = false
+	stream.tagBuf.Reset()
+	stream.tags = newXMLWriter(&stream.tagBuf)
+	err := stream.tags.StartElement(*start)
+	if err == nil {
+		err = stream.send(stream.tagBuf.Bytes())
 	}
-	if err := stream.send(buf.Bytes()); err != nil {
+	stream.wlock.Unlock()
+	if err != nil {
 		return nil, err
 	}
 
-	// Read and return start of incoming doc.
-	rstart, err := nextStartElement(stream.dec)
+	// Read and return start of incoming doc. A new document is started each
+	// time the stream is (re)started.
+	stream.resetDecoder()
+	rstart, _, err := stream.nextStartElement()
 	if err != nil {
 		return nil, err
 	}
-
-	// Collect top-level namespaces.
-	stream.incomingNamespace = make(nsMap)
-	for _, attr := range rstart.Attr {
-		if attr.Name.Space == "xmlns" {
-			stream.incomingNamespace[attr.Value] = attr.Name.Local
-		} else if attr.Name.Space == "" && attr.Name.Local == "xmlns" {
-			stream.incomingNamespace[attr.Value] = ""
-		}
+	stream.r.discard(stream.dec.InputOffset())
+
+	// Stanzas inherit the xml:lang of the header of the stream they're sent
+	// over (RFC 6120 section 4.7.4), so each direction has its own default.
+	// If the receiving entity did not declare one, the language requested
+	// still applies.
+	stream.sendLang = streamLang(start)
+	stream.recvLang = streamLang(rstart)
+	if stream.recvLang == "" {
+		stream.recvLang = stream.sendLang
 	}
 
 	return rstart, nil
 }
 
-// Send the end element that closes the stream.
+// Return the default language of the stanzas sent, i.e. the xml:lang of the
+// sent stream header. Returns "" if it has none.
+func (stream *Stream) SendLang() string {
+	return stream.sendLang
+}
+
+// Return the default language of the stanzas received, i.e. the xml:lang of
+// the received stream header, or of the sent header if the received one has
+// none. Returns "" if neither has one.
+func (stream *Stream) RecvLang() string {
+	return stream.recvLang
+}
+
+// Return the xml:lang attribute of the stream header.
+func streamLang(start *xml.StartElement) string {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "lang" && (attr.Name.Space == nsXML || attr.Name.Space == "xml") {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Send the end element that closes the stream. Does nothing if the stream has
+// already been closed, e.g. after a stream error.
 func (stream *Stream) SendEnd(end *xml.EndElement) error {
-	buf := new(bytes.Buffer)
-	if err := writeXMLEndElement(buf, end); err != nil {
+	stream.wlock.Lock()
+	defer stream.wlock.Unlock()
+	if stream.ended {
+		return nil
+	}
+	if stream.tags == nil {
+		return errors.New("xmpp: stream not started")
+	}
+	stream.tagBuf.Reset()
+	if err := stream.tags.EndElement(*end); err != nil {
+		return err
+	}
+	stream.ended = true
+	return stream.send(stream.tagBuf.Bytes())
+}
+
+// Send a stream error and close the stream. The net connection is left open
+// so the peer can close its end of the stream.
+func (stream *Stream) SendError(e *StreamError) error {
+	stream.wlock.Lock()
+	defer stream.wlock.Unlock()
+	if stream.ended {
+		return nil
+	}
+	if stream.tags == nil {
+		return errors.New("xmpp: stream not started")
+	}
+	if err := stream.encode(e); err != nil {
 		return err
 	}
-	if err := stream.send(buf.Bytes()); err != nil {
+	stream.tagBuf.Reset()
+	if err := stream.tags.Close(); err != nil {
 		return err
 	}
-	return nil
+	stream.ended = true
+	return stream.send(stream.tagBuf.Bytes())
 }
 
-// Send a stanza. Used to write a complete, top-level element.
+// Close the stream's underlying net connection.
+func (stream *Stream) Close() error {
+	return stream.conn.Close()
+}
+
+// Send a stanza. Used to write a complete, top-level element. The stanza,
+// and anything already buffered by Encode, is written to the net connection
+// immediately.
 func (stream *Stream) Send(v interface{}) error {
-	if stream.config.LogStanzas {
-		bytes, err := xml.Marshal(v)
-		if err != nil {
-			return err
-		}
-		return stream.send(bytes)
+	stream.wlock.Lock()
+	defer stream.wlock.Unlock()
+	if err := stream.encode(v); err != nil {
+		return err
 	}
-	enc := xml.NewEncoder(stream.conn)
-	return enc.Encode(v)
+	return stream.w.Flush()
 }
 
+// Encode a stanza into the stream's write buffer. The buffer is written to the
+// net connection when it fills up or by calling Flush, allowing many stanzas
+// to be written with a single write to the net connection.
+func (stream *Stream) Encode(v interface{}) error {
+	stream.wlock.Lock()
+	defer stream.wlock.Unlock()
+	return stream.encode(v)
+}
+
+// Encode into the write buffer. Must be called with wlock held.
+func (stream *Stream) encode(v interface{}) error {
+	if stream.ended {
+		return ErrStreamClosed
+	}
+	stream.encBuf.Reset()
+	if err := stream.enc.Encode(v); err != nil {
+		// The encoder's state is unknown after an error, start again.
+		stream.enc = xml.NewEncoder(&stream.encBuf)
+		return err
+	}
+	return stream.write(stream.encBuf.Bytes())
+}
+
+// Write any buffered data to the net connection.
+func (stream *Stream) Flush() error {
+	stream.wlock.Lock()
+	defer stream.wlock.Unlock()
+	return stream.w.Flush()
+}
+
+// Write the data and flush. Must be called with wlock held.
 func (stream *Stream) send(b []byte) error {
+	if err := stream.write(b); err != nil {
+		return err
+	}
+	return stream.w.Flush()
+}
+
+// Write the data to the buffer. Must be called with wlock held.
+func (stream *Stream) write(b []byte) error {
 	if stream.config.LogStanzas {
 		log.Println("send:", string(b))
 	}
-	if _, err := stream.conn.Write(b); err != nil {
+	if _, err := stream.w.Write(b); err != nil {
 		return err
 	}
 	return nil
@@ -141,46 +339,32 @@ func (stream *Stream) send(b []byte) error {
 // Bad things are very likely to happen if a call to Next() is successful but
 // you don't actually decode or skip the element.
 func (stream *Stream) Next() (*xml.StartElement, error) {
-
-	start, err := nextStartElement(stream.dec)
+	start, offset, err := stream.nextStartElement()
 	if err != nil {
-		return nil, err
+		return nil, stream.fail(err)
 	}
-
-	if stream.config.LogStanzas {
-		xml, err := collectElement(stream.dec, start, stream.incomingNamespace)
-		if err != nil {
-			return nil, err
-		}
-		stream.stanzaBuf = xml
-		log.Println("recv:", stream.stanzaBuf)
-	}
-
+	stream.stanzaStart = offset
+	stream.r.discard(offset)
 	return start, nil
 }
 
-func nextStartElement(dec *xml.Decoder) (*xml.StartElement, error) {
+// Return the next start element and the input offset it starts at.
+func (stream *Stream) nextStartElement() (*xml.StartElement, int64, error) {
 	for {
-		t, err := dec.Token()
+		offset := stream.dec.InputOffset()
+		t, err := stream.dec.Token()
 		if err != nil {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
 			}
-			return nil, err
+			return nil, 0, err
 		}
 		switch e := t.(type) {
 		case xml.StartElement:
-			for i := range e.Attr {
-				// Replace URL namespace to xml in order to avoid error on Unmarshal
-				// It's quite ugly, but working for now
-				if e.Attr[i].Name.Space == "http://www.w3.org/XML/1998/namespace" {
-					e.Attr[i].Name.Space = "xml"
-				}
-			}
-			return &e, nil
+			return &e, offset, nil
 		case xml.EndElement:
 			log.Printf("EOF due to %s\n", e.Name)
-			return nil, io.EOF
+			return nil, 0, io.EOF
 		}
 	}
 }
@@ -188,17 +372,17 @@ func nextStartElement(dec *xml.Decoder) (*xml.StartElement, error) {
 // Skip reads tokens until it reaches the end element of the most recent start
 // element that has already been read.
 func (stream *Stream) Skip() error {
-	if stream.config.LogStanzas && stream.stanzaBuf != "" {
-		stream.stanzaBuf = ""
-		return nil
+	if err := stream.dec.Skip(); err != nil {
+		return stream.fail(err)
 	}
-	return stream.dec.Skip()
+	return stream.endStanza()
 }
 
 // Decode a stanza.
 // If start is not nil, the stanza for the start element that's already been
 // consumed is read. A nil start will read the next stanza in the stream.
-// See xml.Decoder.DecodeElement for decoding rules.
+// See xml.Decoder.DecodeElement for decoding rules. A stanza that's read but
+// has a value that can't be decoded is reported as a *DecodeError.
 func (stream *Stream) Decode(v interface{}, start *xml.StartElement) error {
 
 	// Explicity lookup next start element to ensure stream is validated,
@@ -211,60 +395,181 @@ func (stream *Stream) Decode(v interface{}, start *xml.StartElement) error {
 		start = se
 	}
 
-	if stream.config.LogStanzas {
-		return xml.Unmarshal([]byte(stream.stanzaBuf), v)
+	if err := stream.dec.DecodeElement(v, start); err != nil {
+		switch err.(type) {
+		case *StreamError, *xml.SyntaxError:
+			return stream.fail(err)
+		}
+		// Anything else that breaks the stream, e.g. a read error, is
+		// returned again by the decoder while skipping. What's left is a
+		// value that couldn't be converted, e.g. a malformed number, so the
+		// rest of the stanza is skipped and the stream carries on.
+		if skipErr := stream.skipStanza(); skipErr != nil {
+			return stream.fail(skipErr)
+		}
+		if endErr := stream.endStanza(); endErr != nil {
+			return endErr
+		}
+		return &DecodeError{Name: start.Name, Err: err}
 	}
+	return stream.endStanza()
+}
+
+// Error returned by Stream.Decode when a stanza was read but one of its
+// values couldn't be decoded, e.g. a malformed number. Unlike other errors
+// from Decode, the stream can still be read.
+type DecodeError struct {
+	// Name of the stanza's element.
+	Name xml.Name
 
-	return stream.dec.DecodeElement(v, start)
+	Err error
 }
 
-// Collect the element with the start that's already been consumed into a
-// buffer. Namespaces are munged so the buffer can be correctly parsed outside
-// the context of the stream. This is used for logging the received data.
-func collectElement(dec *xml.Decoder, start *xml.StartElement, nsmap nsMap) (string, error) {
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode <%s/>: %v", e.Name.Local, e.Err)
+}
 
-	var collector struct {
-		XML []byte `xml:",innerxml"`
-	}
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
 
-	if err := dec.DecodeElement(&collector, start); err != nil {
-		return "", err
+// Read the rest of a stanza that failed to decode part way through. The
+// decoder reads a byte at a time, so the limiter has seen exactly the data
+// that's been decoded and its depth is the number of elements still open,
+// including the stream's.
+func (stream *Stream) skipStanza() error {
+	open := stream.r.limiter.depth - 1
+	for first := true; open > 0; first = false {
+		offset := stream.dec.InputOffset()
+		t, err := stream.dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			open++
+		case xml.EndElement:
+			// The end of an empty element, e.g. <x/>, that was read before
+			// the failure. The limiter never counted it as open.
+			if first && stream.dec.InputOffset() == offset {
+				continue
+			}
+			open--
+		}
 	}
+	return nil
+}
 
-	name := start.Name
-	attrs := start.Attr
+// Terminate the stream with a stream error if err is due to the peer sending
+// bad XML. Returns err.
+func (stream *Stream) fail(err error) error {
+	var streamErr *StreamError
+	switch e := err.(type) {
+	case *StreamError:
+		streamErr = e
+	case *xml.SyntaxError:
+		streamErr = &StreamError{Condition: StreamErrorNotWellFormed}
+	default:
+		return err
+	}
+	if sendErr := stream.SendError(streamErr); sendErr != nil {
+		log.Println("Error. Failed to send stream error. ", sendErr)
+	}
+	return err
+}
 
-	// Map the element's namespace.
-	if ns, ok := nsmap[name.Space]; ok {
-		// Element's namespace is one of the stream namespaces. Update the
-		// element's namespace and add the namespace to the element's attrs.
-		attrs = append(attrs, xml.Attr{xml.Name{"xmlns", ns}, name.Space})
-		name = xml.Name{ns, name.Local}
-	} else {
-		// Check that Go's xml package hasn't duplicated the default ns as the
-		// element name's space. If so, clear it.
-		for _, attr := range attrs {
-			if attr.Name == (xml.Name{"", "xmlns"}) {
-				if name.Space == attr.Value {
-					name = xml.Name{"", start.Name.Local}
-				}
-				break
-			}
+// Pass the raw data of the element that's just been read to the logger and
+// tee.
+func (stream *Stream) endStanza() error {
+	end := stream.dec.InputOffset()
+	raw := stream.r.recorded(stream.stanzaStart, end)
+	stream.r.discard(end)
+	if raw == nil {
+		return nil
+	}
+	if stream.config.LogStanzas {
+		log.Println("recv:", string(raw))
+	}
+	if stream.config.RecvTee != nil {
+		if _, err := stream.config.RecvTee.Write(raw); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// Reader that records the data read so the raw data of an element can be
+// recovered from the decoder's input offsets. Implements io.ByteReader so the
+// decoder doesn't add its own buffering and read ahead. Every byte is also
+// checked by the limiter.
+type recordingReader struct {
+	r       *bufio.Reader
+	record  bool
+	limiter *xmlLimiter
+
+	// Data read, starting at input offset base.
+	buf  []byte
+	base int64
+}
 
-	start = &xml.StartElement{name, attrs}
+func newRecordingReader(r io.Reader, record bool, limiter *xmlLimiter) *recordingReader {
+	return &recordingReader{r: bufio.NewReader(r), record: record, limiter: limiter}
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := r.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+		if r.r.Buffered() == 0 {
+			return i + 1, nil
+		}
+	}
+	return len(p), nil
+}
 
-	buf := new(bytes.Buffer)
-	if err := writeXMLStartElement(buf, start); err != nil {
-		return "", err
+func (r *recordingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	if err := r.limiter.check(b); err != nil {
+		return 0, err
 	}
-	if _, err := buf.Write(collector.XML); err != nil {
-		return "", err
+	if r.record {
+		r.buf = append(r.buf, b)
 	}
-	if err := writeXMLEndElement(buf, &xml.EndElement{start.Name}); err != nil {
-		return "", err
+	return b, nil
+}
+
+// Start counting input offsets from zero again, for a new document.
+func (r *recordingReader) reset() {
+	r.buf, r.base = r.buf[:0], 0
+	r.limiter.reset()
+}
+
+// Return a copy of the data between the input offsets, or nil if nothing is
+// being recorded.
+func (r *recordingReader) recorded(start, end int64) []byte {
+	if !r.record || start < r.base || end-r.base > int64(len(r.buf)) {
+		return nil
 	}
+	raw := make([]byte, end-start)
+	copy(raw, r.buf[start-r.base:end-r.base])
+	return raw
+}
 
-	return buf.String(), nil
+// Forget data before the input offset.
+func (r *recordingReader) discard(offset int64) {
+	if !r.record || offset <= r.base {
+		return
+	}
+	n := offset - r.base
+	if n > int64(len(r.buf)) {
+		n = int64(len(r.buf))
+	}
+	r.buf = r.buf[:copy(r.buf, r.buf[n:])]
+	r.base += n
 }
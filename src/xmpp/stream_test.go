@@ -0,0 +1,265 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a TCP connection to a local server that discards everything it's
+// sent.
+func discardConn(b *testing.B) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+var benchmarkMessage = &Message{
+	To:   "bob@wonderland.lit/phone",
+	From: "alice@wonderland.lit/laptop",
+	Type: MessageTypeChat,
+	Body: []MessageBody{{Value: "Off with their heads!"}},
+}
+
+// The previous write path: a new encoder per stanza writing directly to the
+// net connection.
+func BenchmarkSendUnbuffered(b *testing.B) {
+	conn := discardConn(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := xml.NewEncoder(conn).Encode(benchmarkMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	stream := newStream(discardConn(b), &StreamConfig{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := stream.Send(benchmarkMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendBatched(b *testing.B) {
+	stream := newStream(discardConn(b), &StreamConfig{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := stream.Encode(benchmarkMessage); err != nil {
+			b.Fatal(err)
+		}
+		if i%maxWriteBatch == 0 {
+			stream.Flush()
+		}
+	}
+	stream.Flush()
+}
+
+// The previous logging write path: marshal to log the stanza then write.
+func BenchmarkSendLogUnbuffered(b *testing.B) {
+	conn := discardConn(b)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := xml.Marshal(benchmarkMessage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		log.Println("send:", string(data))
+		if _, err := conn.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendLogBatched(b *testing.B) {
+	stream := newStream(discardConn(b), &StreamConfig{LogStanzas: true})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := stream.Encode(benchmarkMessage); err != nil {
+			b.Fatal(err)
+		}
+		if i%maxWriteBatch == 0 {
+			stream.Flush()
+		}
+	}
+	stream.Flush()
+}
+
+func TestRecvTee(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	tee := new(teeRecorder)
+	stream := newStream(client, &StreamConfig{RecvTee: tee})
+
+	stanzas := []string{
+		"<message to='alice@wonderland.lit'><body>Hi &amp; bye</body></message>",
+		"<presence/>",
+		"<iq type='get' id='1'><ping xmlns='urn:xmpp:ping'/></iq>",
+	}
+	go func() {
+		server.Write([]byte("<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>\n"))
+		for _, stanza := range stanzas {
+			server.Write([]byte(stanza + "\n "))
+		}
+	}()
+	if _, _, err := stream.nextStartElement(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{}
+	if err := stream.Decode(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body[0].Value != "Hi & bye" {
+		t.Errorf("unexpected body: %q", msg.Body[0].Value)
+	}
+	if _, err := stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	iq := &IQ{}
+	if err := stream.Decode(iq, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tee.writes) != len(stanzas) {
+		t.Fatalf("expected %d writes, got %d", len(stanzas), len(tee.writes))
+	}
+	for i, stanza := range stanzas {
+		if tee.writes[i] != stanza {
+			t.Errorf("expected %q, got %q", stanza, tee.writes[i])
+		}
+	}
+}
+
+func TestDecodeValueError(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := newStream(client, &StreamConfig{})
+	go func() {
+		server.Write([]byte("<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"))
+		server.Write([]byte("<a><n>x</n><b/></a>"))
+		server.Write([]byte("<a><b><c n='x'/></b><n>1</n></a>"))
+		server.Write([]byte("<a><n>1</n></a>"))
+	}()
+	if _, _, err := stream.nextStartElement(); err != nil {
+		t.Fatal(err)
+	}
+
+	type value struct {
+		N int `xml:"n"`
+		C struct {
+			N int `xml:"n,attr"`
+		} `xml:"b>c"`
+	}
+	for i := 0; i < 2; i++ {
+		var decodeErr *DecodeError
+		if err := stream.Decode(&value{}, nil); !errors.As(err, &decodeErr) || decodeErr.Name.Local != "a" {
+			t.Fatalf("expected *DecodeError, got %v", err)
+		}
+	}
+	v := &value{}
+	if err := stream.Decode(v, nil); err != nil || v.N != 1 {
+		t.Errorf("unexpected value: %+v, %v", v, err)
+	}
+}
+
+type teeRecorder struct {
+	writes []string
+}
+
+func (r *teeRecorder) Write(b []byte) (int, error) {
+	r.writes = append(r.writes, string(b))
+	return len(b), nil
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		config    StreamConfig
+		stanza    string
+		condition ErrorCondition
+	}{
+		{StreamConfig{MaxStanzaBytes: 256}, "<message><body>" + strings.Repeat("x", 256) + "</body></message>", StreamErrorPolicyViolation},
+		{StreamConfig{MaxDepth: 2}, "<message><a><b><c/></b></a></message>", StreamErrorPolicyViolation},
+		{StreamConfig{MaxAttributes: 2}, "<message a='1' b='2' c='3'/>", StreamErrorPolicyViolation},
+		{StreamConfig{}, "<message><!-- comment --></message>", StreamErrorRestrictedXML},
+		{StreamConfig{}, "<?pi data?><message/>", StreamErrorRestrictedXML},
+		{StreamConfig{}, "<message><body>&custom;</body></message>", StreamErrorRestrictedXML},
+		{StreamConfig{}, "<message><body>&lt;&#65;<![CDATA[<!--]]></body></message>", ErrorCondition{}},
+		{StreamConfig{MaxStanzaBytes: -1, MaxDepth: -1, MaxAttributes: -1}, "<message a='1' b='2'><a><b/></a></message>", ErrorCondition{}},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		stream := newStream(client, &test.config)
+
+		sent := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(server)
+			sent <- string(b)
+		}()
+		go func() {
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			server.Write([]byte("<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"))
+			server.Write([]byte(test.stanza))
+		}()
+		start := &xml.StartElement{
+			Name: xml.Name{Space: nsStreams, Local: "stream"},
+			Attr: []xml.Attr{{Name: xml.Name{Space: "xmlns", Local: "stream"}, Value: nsStreams}},
+		}
+		if _, err := stream.SendStart(start); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := stream.Next()
+		if err == nil {
+			err = stream.Skip()
+		}
+		client.Close()
+		out := <-sent
+		server.Close()
+
+		if test.condition == (ErrorCondition{}) {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.stanza, err)
+			}
+			continue
+		}
+		streamErr, ok := err.(*StreamError)
+		if !ok || streamErr.Condition != test.condition {
+			t.Errorf("%s: expected %s stream error, got %v", test.stanza, test.condition.Local, err)
+			continue
+		}
+		if !strings.Contains(out, "<"+test.condition.Local) || !strings.HasSuffix(out, "</stream:stream>") {
+			t.Errorf("%s: stream error not sent: %q", test.stanza, out)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Stream error conditions.
+var (
+	StreamErrorNotWellFormed   = ErrorCondition{nsErrorStreams, "not-well-formed"}
+	StreamErrorPolicyViolation = ErrorCondition{nsErrorStreams, "policy-violation"}
+	StreamErrorRestrictedXML   = ErrorCondition{nsErrorStreams, "restricted-xml"}
+)
+
+// XMPP <stream:error/>. Stream errors are unrecoverable, the stream is closed
+// after one is sent.
+type StreamError struct {
+	Condition ErrorCondition
+	Text      string
+}
+
+func (e *StreamError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("stream error: %s", e.Condition.Local)
+	}
+	return fmt.Sprintf("stream error: %s, %s", e.Condition.Local, e.Text)
+}
+
+// Report whether the target is the error's condition, allowing errors.Is to
+// test for a condition, e.g. errors.Is(err, StreamErrorPolicyViolation).
+func (e *StreamError) Is(target error) bool {
+	condition, ok := target.(ErrorCondition)
+	return ok && condition == e.Condition
+}
+
+// Implement xml.Marshaler.
+func (e *StreamError) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Space: nsStreams, Local: "error"}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	condition := xml.StartElement{Name: xml.Name(e.Condition)}
+	if err := enc.EncodeToken(condition); err != nil {
+		return err
+	}
+	if err := enc.EncodeToken(condition.End()); err != nil {
+		return err
+	}
+	if e.Text != "" {
+		text := errorText{xml.Name{Space: nsErrorStreams, Local: "text"}, e.Text}
+		if err := enc.Encode(text); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
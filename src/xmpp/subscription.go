@@ -0,0 +1,371 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+const NSPreApproval = "urn:xmpp:features:pre-approval"
+
+// Returned by PreApprove if the server does not support subscription
+// pre-approval.
+var ErrPreApprovalNotSupported = errors.New("xmpp: subscription pre-approval not supported")
+
+// State of the presence subscriptions between the account and a contact, as
+// defined in RFC 6121 appendix A. "To" means the account receives the
+// contact's presence, "From" means the contact receives the account's
+// presence. "Pending out" is an unanswered request sent by the account,
+// "pending in" an unanswered request from the contact.
+type SubscriptionState int
+
+const (
+	SubscriptionNone SubscriptionState = iota
+	SubscriptionNonePendingOut
+	SubscriptionNonePendingIn
+	SubscriptionNonePendingOutIn
+	SubscriptionTo
+	SubscriptionToPendingIn
+	SubscriptionFrom
+	SubscriptionFromPendingOut
+	SubscriptionBoth
+)
+
+var subscriptionStateNames = [...]string{
+	SubscriptionNone:             "None",
+	SubscriptionNonePendingOut:   "None + Pending Out",
+	SubscriptionNonePendingIn:    "None + Pending In",
+	SubscriptionNonePendingOutIn: "None + Pending Out/In",
+	SubscriptionTo:               "To",
+	SubscriptionToPendingIn:      "To + Pending In",
+	SubscriptionFrom:             "From",
+	SubscriptionFromPendingOut:   "From + Pending Out",
+	SubscriptionBoth:             "Both",
+}
+
+// Return the state's name, as used in RFC 6121.
+func (s SubscriptionState) String() string {
+	if s < 0 || int(s) >= len(subscriptionStateNames) {
+		return "Unknown"
+	}
+	return subscriptionStateNames[s]
+}
+
+// Return true if the account is subscribed to the contact's presence.
+func (s SubscriptionState) To() bool {
+	return s == SubscriptionTo || s == SubscriptionToPendingIn || s == SubscriptionBoth
+}
+
+// Return true if the contact is subscribed to the account's presence.
+func (s SubscriptionState) From() bool {
+	return s == SubscriptionFrom || s == SubscriptionFromPendingOut || s == SubscriptionBoth
+}
+
+// Return true if the account has asked to subscribe to the contact's presence
+// and is waiting for an answer.
+func (s SubscriptionState) PendingOut() bool {
+	return s == SubscriptionNonePendingOut || s == SubscriptionNonePendingOutIn || s == SubscriptionFromPendingOut
+}
+
+// Return true if the contact has asked to subscribe to the account's presence
+// and is waiting for an answer.
+func (s SubscriptionState) PendingIn() bool {
+	return s == SubscriptionNonePendingIn || s == SubscriptionNonePendingOutIn || s == SubscriptionToPendingIn
+}
+
+// Return the state for a roster item's subscription and ask attributes, and
+// whether there's a request from the contact waiting for an answer.
+func subscriptionState(subscription, ask string, pendingIn bool) SubscriptionState {
+	pendingOut := ask == RosterAskSubscribe
+	switch subscription {
+	case RosterSubscriptionBoth:
+		return SubscriptionBoth
+	case RosterSubscriptionTo:
+		if pendingIn {
+			return SubscriptionToPendingIn
+		}
+		return SubscriptionTo
+	case RosterSubscriptionFrom:
+		if pendingOut {
+			return SubscriptionFromPendingOut
+		}
+		return SubscriptionFrom
+	}
+	switch {
+	case pendingOut && pendingIn:
+		return SubscriptionNonePendingOutIn
+	case pendingOut:
+		return SubscriptionNonePendingOut
+	case pendingIn:
+		return SubscriptionNonePendingIn
+	}
+	return SubscriptionNone
+}
+
+// Request from a contact to subscribe to the account's presence.
+type SubscriptionRequest struct {
+	// Bare JID of the contact.
+	From JID
+
+	// The <presence type="subscribe"/> stanza, e.g. to get the status text or
+	// a preauth token.
+	Presence *Presence
+}
+
+// What to do with an incoming subscription request.
+type SubscriptionDecision int
+
+const (
+	// Keep the request until the application calls Approve or Deny.
+	SubscriptionQueue SubscriptionDecision = iota
+
+	// Approve the request immediately.
+	SubscriptionApprove
+
+	// Deny the request immediately.
+	SubscriptionDeny
+)
+
+// Decide what to do with an incoming subscription request. Called from the
+// goroutine handling subscription requests and must not block.
+type SubscriptionPolicy func(req SubscriptionRequest) SubscriptionDecision
+
+// Policy that approves requests from the domains, and queues everything else.
+func ApproveDomains(domains ...string) SubscriptionPolicy {
+	allowed := make(map[string]bool)
+	for _, domain := range domains {
+		if d, err := prepareDomain(domain); err == nil {
+			allowed[d] = true
+		}
+	}
+	return func(req SubscriptionRequest) SubscriptionDecision {
+		if allowed[req.From.Domain] {
+			return SubscriptionApprove
+		}
+		return SubscriptionQueue
+	}
+}
+
+// Subscription manager configuration.
+type SubscriptionConfig struct {
+	// Decide what to do with incoming requests. All requests are queued if
+	// nil.
+	Policy SubscriptionPolicy
+
+	// Called when a request is queued for the application to answer. Must not
+	// block.
+	OnRequest func(req SubscriptionRequest)
+}
+
+// Presence subscription manager (RFC 6121 section 3). Answers incoming
+// subscription requests according to its policy, keeps track of the requests
+// waiting for an answer and provides the subscription state of each contact.
+// Subscription state changes are reflected in the roster by the server's
+// roster pushes.
+type Subscriptions struct {
+	XMPP *XMPP
+
+	// Roster the subscription states are taken from. May be nil, in which
+	// case only the requests waiting for an answer are known.
+	Roster *Roster
+	config *SubscriptionConfig
+
+	// Filters for requests, which are consumed, and for cancellations, which
+	// are copied.
+	requestFid FilterID
+	cancelFid  FilterID
+
+	lock    sync.Mutex
+	pending map[JID]SubscriptionRequest
+}
+
+// Create a subscription manager and start handling incoming subscription
+// requests. Incoming <presence type="subscribe"/> stanzas are consumed by the
+// manager. Other subscription related presences, including the
+// <presence type="unsubscribe"/> that cancels a request, are still delivered
+// as usual.
+func NewSubscriptions(x *XMPP, roster *Roster, config *SubscriptionConfig) *Subscriptions {
+	if config == nil {
+		config = &SubscriptionConfig{}
+	}
+	subs := &Subscriptions{XMPP: x, Roster: roster, config: config, pending: make(map[JID]SubscriptionRequest)}
+	requestFid, requests := x.AddFilterMode(And(StanzaKind("presence"), StanzaType(string(PresenceTypeSubscribe))), FilterExclusive)
+	cancelFid, cancels := x.AddFilterMode(And(StanzaKind("presence"), StanzaType(string(PresenceTypeUnsubscribe))), FilterCopy)
+	subs.requestFid, subs.cancelFid = requestFid, cancelFid
+
+	// One goroutine for both, so a request and its cancellation are handled
+	// in the order they were received.
+	go func() {
+		for requests != nil || cancels != nil {
+			select {
+			case v, ok := <-requests:
+				if !ok {
+					requests = nil
+					continue
+				}
+				subs.handle(v.(*Presence))
+			case v, ok := <-cancels:
+				if !ok {
+					cancels = nil
+					continue
+				}
+				subs.handle(v.(*Presence))
+			}
+		}
+	}()
+	return subs
+}
+
+// Stop handling subscription requests.
+func (subs *Subscriptions) Close() error {
+	err := subs.XMPP.RemoveFilter(subs.requestFid)
+	if cancelErr := subs.XMPP.RemoveFilter(subs.cancelFid); err == nil {
+		err = cancelErr
+	}
+	return err
+}
+
+func (subs *Subscriptions) handle(presence *Presence) {
+	from, err := presence.FromJID()
+	if err != nil || from.Domain == "" {
+		return
+	}
+	from.Resource = ""
+
+	// A contact that cancels its request, or its subscription, no longer
+	// needs an answer (RFC 6121 section 3.3).
+	if presence.Type == PresenceTypeUnsubscribe {
+		subs.lock.Lock()
+		delete(subs.pending, from)
+		subs.lock.Unlock()
+		return
+	}
+
+	// The server normally answers requests from contacts that are already
+	// subscribed, or pre-approved, but may not.
+	req := SubscriptionRequest{From: from, Presence: presence}
+	decision := SubscriptionQueue
+	if item, ok := subs.rosterItem(from); ok && (item.Approved || subscriptionState(item.Subscription, item.Ask, false).From()) {
+		decision = SubscriptionApprove
+	} else if subs.config.Policy != nil {
+		decision = subs.config.Policy(req)
+	}
+
+	answer := PresenceTypeSubscribed
+	switch decision {
+	case SubscriptionApprove:
+	case SubscriptionDeny:
+		answer = PresenceTypeUnsubscribed
+	default:
+		subs.queue(req)
+		return
+	}
+
+	// A request that can't be answered now is left for the application.
+	if err := subs.send(context.Background(), from, answer); err != nil {
+		log.Println("Error. Failed to answer subscription request. ", err)
+		subs.queue(req)
+	}
+}
+
+// Keep the request until the application answers it.
+func (subs *Subscriptions) queue(req SubscriptionRequest) {
+	subs.lock.Lock()
+	subs.pending[req.From] = req
+	subs.lock.Unlock()
+	if subs.config.OnRequest != nil {
+		subs.config.OnRequest(req)
+	}
+}
+
+// Send a subscription presence to the JID's bare JID.
+func (subs *Subscriptions) send(ctx context.Context, jid JID, presenceType PresenceType) error {
+	return subs.XMPP.Send(ctx, &Presence{To: jid.Bare(), Type: presenceType})
+}
+
+// Forget the pending request from the JID's bare JID, once answered.
+func (subs *Subscriptions) answered(jid JID) {
+	jid = jid.normalise()
+	jid.Resource = ""
+	subs.lock.Lock()
+	delete(subs.pending, jid)
+	subs.lock.Unlock()
+}
+
+// Ask to subscribe to the contact's presence.
+func (subs *Subscriptions) Request(ctx context.Context, jid JID) error {
+	return subs.send(ctx, jid, PresenceTypeSubscribe)
+}
+
+// Approve the contact's request to subscribe to the account's presence.
+func (subs *Subscriptions) Approve(ctx context.Context, jid JID) error {
+	if err := subs.send(ctx, jid, PresenceTypeSubscribed); err != nil {
+		return err
+	}
+	subs.answered(jid)
+	return nil
+}
+
+// Deny the contact's request to subscribe to the account's presence.
+func (subs *Subscriptions) Deny(ctx context.Context, jid JID) error {
+	if err := subs.send(ctx, jid, PresenceTypeUnsubscribed); err != nil {
+		return err
+	}
+	subs.answered(jid)
+	return nil
+}
+
+// Cancel the contact's subscription to the account's presence, or a
+// pre-approval.
+func (subs *Subscriptions) Cancel(ctx context.Context, jid JID) error {
+	return subs.Deny(ctx, jid)
+}
+
+// Unsubscribe from the contact's presence, or withdraw a request to
+// subscribe.
+func (subs *Subscriptions) Unsubscribe(ctx context.Context, jid JID) error {
+	return subs.send(ctx, jid, PresenceTypeUnsubscribe)
+}
+
+// Approve a request from the contact before it's made (RFC 6121 section 3.4).
+// Returns ErrPreApprovalNotSupported if the server does not advertise
+// support.
+func (subs *Subscriptions) PreApprove(ctx context.Context, jid JID) error {
+	if f := subs.XMPP.features; f == nil || f.PreApproval == nil {
+		return ErrPreApprovalNotSupported
+	}
+	return subs.send(ctx, jid, PresenceTypeSubscribed)
+}
+
+// Return the requests waiting for an answer, ordered by JID.
+func (subs *Subscriptions) Pending() []SubscriptionRequest {
+	subs.lock.Lock()
+	defer subs.lock.Unlock()
+	reqs := make([]SubscriptionRequest, 0, len(subs.pending))
+	for _, req := range subs.pending {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].From.Bare() < reqs[j].From.Bare() })
+	return reqs
+}
+
+// Return the subscription state of the contact with the JID's bare JID.
+func (subs *Subscriptions) State(jid JID) SubscriptionState {
+	jid = jid.normalise()
+	jid.Resource = ""
+	subs.lock.Lock()
+	_, pendingIn := subs.pending[jid]
+	subs.lock.Unlock()
+	item, _ := subs.rosterItem(jid)
+	return subscriptionState(item.Subscription, item.Ask, pendingIn)
+}
+
+// Return the contact's roster item, if there's a roster and it has one.
+func (subs *Subscriptions) rosterItem(jid JID) (RosterItem, bool) {
+	if subs.Roster == nil {
+		return RosterItem{}, false
+	}
+	return subs.Roster.Item(jid)
+}
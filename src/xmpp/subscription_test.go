@@ -0,0 +1,144 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionState(t *testing.T) {
+	tests := []struct {
+		subscription, ask string
+		pendingIn         bool
+		state             SubscriptionState
+	}{
+		{"", "", false, SubscriptionNone},
+		{RosterSubscriptionNone, RosterAskSubscribe, false, SubscriptionNonePendingOut},
+		{RosterSubscriptionNone, "", true, SubscriptionNonePendingIn},
+		{RosterSubscriptionNone, RosterAskSubscribe, true, SubscriptionNonePendingOutIn},
+		{RosterSubscriptionTo, "", true, SubscriptionToPendingIn},
+		{RosterSubscriptionFrom, RosterAskSubscribe, false, SubscriptionFromPendingOut},
+		{RosterSubscriptionBoth, "", false, SubscriptionBoth},
+	}
+	for _, test := range tests {
+		if state := subscriptionState(test.subscription, test.ask, test.pendingIn); state != test.state {
+			t.Errorf("%q %q %v: expected %v, got %v", test.subscription, test.ask, test.pendingIn, test.state, state)
+		}
+	}
+	if !SubscriptionToPendingIn.To() || !SubscriptionToPendingIn.PendingIn() || SubscriptionToPendingIn.From() {
+		t.Error("unexpected To + Pending In")
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	x, s := newTestXMPP(t)
+	roster := NewRoster(x, nil)
+	defer roster.Close()
+	requests := make(chan SubscriptionRequest, 1)
+	subs := NewSubscriptions(x, roster, &SubscriptionConfig{
+		Policy:    ApproveDomains("Wonderland.lit"),
+		OnRequest: func(req SubscriptionRequest) { requests <- req },
+	})
+	defer subs.Close()
+
+	recv := func() *Presence {
+		presence := &Presence{}
+		if err := s.dec.Decode(presence); err != nil {
+			t.Fatal(err)
+		}
+		return presence
+	}
+
+	s.send(t, "<presence type='subscribe' from='hatter@wonderland.lit/tea'/>")
+	if p := recv(); p.Type != PresenceTypeSubscribed || p.To != "hatter@wonderland.lit" {
+		t.Errorf("unexpected presence: %+v", p)
+	}
+
+	s.send(t, "<presence type='subscribe' from='Queen@Hearts.lit'><status>Off with her head</status></presence>")
+	req := <-requests
+	if req.From.Bare() != "queen@hearts.lit" || req.Presence.StatusText() != "Off with her head" {
+		t.Errorf("unexpected request: %+v", req)
+	}
+	queen := MustParseJID("queen@hearts.lit")
+	if state := subs.State(queen); state != SubscriptionNonePendingIn {
+		t.Errorf("unexpected state: %v", state)
+	}
+	if pending := subs.Pending(); len(pending) != 1 {
+		t.Errorf("unexpected pending: %+v", pending)
+	}
+
+	go func() {
+		if err := subs.Deny(context.Background(), queen); err != nil {
+			t.Error(err)
+		}
+	}()
+	if p := recv(); p.Type != PresenceTypeUnsubscribed || p.To != "queen@hearts.lit" {
+		t.Errorf("unexpected presence: %+v", p)
+	}
+	waitFor(t, "no pending requests", func() bool { return len(subs.Pending()) == 0 })
+	if state := subs.State(queen); state != SubscriptionNone {
+		t.Errorf("unexpected state: %v", state)
+	}
+
+	if err := subs.PreApprove(context.Background(), queen); err != ErrPreApprovalNotSupported {
+		t.Errorf("expected ErrPreApprovalNotSupported, got %v", err)
+	}
+}
+
+func TestSubscriptionCancelled(t *testing.T) {
+	x, s := newTestXMPP(t)
+	roster := NewRoster(x, nil)
+	defer roster.Close()
+	subs := NewSubscriptions(x, roster, nil)
+	defer subs.Close()
+
+	s.send(t, "<presence type='subscribe' from='queen@hearts.lit'/>")
+	waitFor(t, "request", func() bool { return len(subs.Pending()) == 1 })
+
+	// The application still sees the cancellation.
+	s.send(t, "<presence type='unsubscribe' from='queen@hearts.lit'/>")
+	select {
+	case v := <-x.In:
+		if p, ok := v.(*Presence); !ok || p.Type != PresenceTypeUnsubscribe {
+			t.Errorf("unexpected stanza: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancellation not delivered")
+	}
+	waitFor(t, "request to be cancelled", func() bool { return len(subs.Pending()) == 0 })
+}
+
+func TestSubscriptionAnswerFailed(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go s.recvEnd(t)
+	x.Close()
+
+	requests := make(chan SubscriptionRequest, 1)
+	subs := NewSubscriptions(x, NewRoster(x, nil), &SubscriptionConfig{
+		Policy:    func(SubscriptionRequest) SubscriptionDecision { return SubscriptionApprove },
+		OnRequest: func(req SubscriptionRequest) { requests <- req },
+	})
+	subs.handle(&Presence{Type: PresenceTypeSubscribe, From: "hatter@wonderland.lit"})
+	if pending := subs.Pending(); len(pending) != 1 {
+		t.Fatalf("request not kept: %+v", pending)
+	}
+	if req := <-requests; req.From.Bare() != "hatter@wonderland.lit" {
+		t.Errorf("unexpected request: %+v", req)
+	}
+}
+
+func TestSubscriptionsWithoutRoster(t *testing.T) {
+	x, s := newTestXMPP(t)
+	subs := NewSubscriptions(x, nil, nil)
+	defer subs.Close()
+
+	queen := MustParseJID("queen@hearts.lit")
+	if state := subs.State(queen); state != SubscriptionNone {
+		t.Errorf("unexpected state: %v", state)
+	}
+	s.send(t, "<presence type='subscribe' from='queen@hearts.lit'/>")
+	waitFor(t, "pending request", func() bool { return len(subs.Pending()) == 1 })
+	if state := subs.State(queen); state != SubscriptionNonePendingIn {
+		t.Errorf("unexpected state: %v", state)
+	}
+}
@@ -0,0 +1,244 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Query action of an xmpp: URI, from the XEP-0147 registry.
+type URIAction string
+
+const (
+	URIActionCommand     URIAction = "command"
+	URIActionDisco       URIAction = "disco"
+	URIActionInvite      URIAction = "invite"
+	URIActionJoin        URIAction = "join"
+	URIActionMessage     URIAction = "message"
+	URIActionPubSub      URIAction = "pubsub"
+	URIActionRecvFile    URIAction = "recvfile"
+	URIActionRegister    URIAction = "register"
+	URIActionRemove      URIAction = "remove"
+	URIActionRoster      URIAction = "roster"
+	URIActionSendFile    URIAction = "sendfile"
+	URIActionSubscribe   URIAction = "subscribe"
+	URIActionUnregister  URIAction = "unregister"
+	URIActionUnsubscribe URIAction = "unsubscribe"
+	URIActionVCard       URIAction = "vcard"
+)
+
+// Key/value pair in the query of an xmpp: URI.
+type URIParam struct {
+	Key   string
+	Value string
+}
+
+// XMPP URI, as described by RFC 5122, e.g.
+// xmpp:romeo@montague.net?message;body=Hello.
+type URI struct {
+	// Account to use to act on the URI, the URI's authority. Optional.
+	Auth JID
+
+	// Entity to interact with.
+	JID JID
+
+	// Query action, e.g. URIActionMessage, or "" if there is none. The
+	// action names are not restricted to the ones defined by this package.
+	// Parameters without an action are kept, as "?;key=value".
+	Action URIAction
+
+	// Parameters of the query action, in the order they appear in the URI.
+	// The same key may appear more than once, e.g. roster groups.
+	Params []URIParam
+
+	// Fragment identifier, e.g. a pubsub item.
+	Fragment string
+}
+
+// Returned, wrapped with a description of the problem, by ParseURI for a
+// string that's not a valid xmpp: URI.
+var ErrInvalidURI = errors.New("invalid xmpp URI")
+
+// Parse an xmpp: URI. Percent-encoded characters are decoded and the JIDs
+// are validated and normalised as by ParseJID.
+func ParseURI(s string) (*URI, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w %q: %s", ErrInvalidURI, s, fmt.Sprintf(format, args...))
+	}
+
+	const scheme = "xmpp:"
+	if len(s) < len(scheme) || !strings.EqualFold(s[:len(scheme)], scheme) {
+		return nil, invalid("not an xmpp: URI")
+	}
+	rest := s[len(scheme):]
+
+	u := &URI{}
+	var err error
+	if i := strings.Index(rest, "#"); i != -1 {
+		if u.Fragment, err = url.PathUnescape(rest[i+1:]); err != nil {
+			return nil, invalid("fragment: %v", err)
+		}
+		rest = rest[:i]
+	}
+	query, hasQuery := "", false
+	if i := strings.Index(rest, "?"); i != -1 {
+		rest, query, hasQuery = rest[:i], rest[i+1:], true
+	}
+
+	// Authority.
+	hasAuth := strings.HasPrefix(rest, "//")
+	if hasAuth {
+		auth := rest[2:]
+		rest = ""
+		if i := strings.Index(auth, "/"); i != -1 {
+			auth, rest = auth[:i], auth[i+1:]
+		}
+		if u.Auth, err = parseURIJID(auth); err != nil {
+			return nil, invalid("authority: %v", err)
+		}
+		if u.Auth.Resource != "" {
+			return nil, invalid("authority has a resource")
+		}
+	}
+
+	// Path, which may only be left out if there's an authority.
+	if rest != "" || !hasAuth {
+		if u.JID, err = parseURIJID(rest); err != nil {
+			return nil, invalid("%v", err)
+		}
+	}
+
+	// Query: action[;key=value]*. The action may only be left out if there
+	// are parameters.
+	if hasQuery {
+		parts := strings.Split(query, ";")
+		action, err := url.PathUnescape(parts[0])
+		if err != nil || action == "" && len(parts) == 1 {
+			return nil, invalid("query action")
+		}
+		u.Action = URIAction(action)
+		for _, part := range parts[1:] {
+			key, value, _ := strings.Cut(part, "=")
+			if key, err = url.PathUnescape(key); err != nil || key == "" {
+				return nil, invalid("query parameter %q", part)
+			}
+			if value, err = url.PathUnescape(value); err != nil {
+				return nil, invalid("query parameter %q", part)
+			}
+			u.Params = append(u.Params, URIParam{key, value})
+		}
+	}
+
+	return u, nil
+}
+
+// Decode and parse a JID from a URI.
+func parseURIJID(s string) (JID, error) {
+	decoded, err := url.PathUnescape(s)
+	if err != nil {
+		return JID{}, err
+	}
+	return ParseJID(decoded)
+}
+
+// Return the value of the first parameter with the key, or false if there is
+// none.
+func (u *URI) Param(key string) (string, bool) {
+	for _, param := range u.Params {
+		if param.Key == key {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+// Return the values of all the parameters with the key.
+func (u *URI) ParamValues(key string) []string {
+	var values []string
+	for _, param := range u.Params {
+		if param.Key == key {
+			values = append(values, param.Value)
+		}
+	}
+	return values
+}
+
+// Add a parameter to the end of the query.
+func (u *URI) AddParam(key, value string) {
+	u.Params = append(u.Params, URIParam{key, value})
+}
+
+// Return the URI as a string, percent-encoding characters as needed. Non-ASCII
+// characters are percent-encoded as UTF-8, i.e. the result is a URI rather
+// than an IRI.
+func (u *URI) String() string {
+	var b strings.Builder
+	b.WriteString("xmpp:")
+	if u.Auth != (JID{}) {
+		b.WriteString("//")
+		writeURIJID(&b, u.Auth)
+		if u.JID != (JID{}) {
+			b.WriteByte('/')
+		}
+	}
+	writeURIJID(&b, u.JID)
+	if u.Action != "" || len(u.Params) > 0 {
+		b.WriteByte('?')
+		b.WriteString(uriEscape(string(u.Action), ""))
+		for _, param := range u.Params {
+			b.WriteByte(';')
+			b.WriteString(uriEscape(param.Key, ""))
+			b.WriteByte('=')
+			b.WriteString(uriEscape(param.Value, ""))
+		}
+	}
+	if u.Fragment != "" {
+		b.WriteByte('#')
+		b.WriteString(uriEscape(u.Fragment, "!$&'()*+,;=:@/?"))
+	}
+	return b.String()
+}
+
+// Characters that may appear unencoded in each part of a JID in a URI, in
+// addition to the unreserved characters. RFC 5122 section 2.2.
+const (
+	uriNodeAllow     = "!$()*+,;="
+	uriDomainAllow   = "!$&'()*+,;=:[]"
+	uriResourceAllow = "!$&'()*+,;=:@"
+)
+
+func writeURIJID(b *strings.Builder, jid JID) {
+	if jid.Node != "" {
+		b.WriteString(uriEscape(jid.Node, uriNodeAllow))
+		b.WriteByte('@')
+	}
+	b.WriteString(uriEscape(jid.Domain, uriDomainAllow))
+	if jid.Resource != "" {
+		b.WriteByte('/')
+		b.WriteString(uriEscape(jid.Resource, uriResourceAllow))
+	}
+}
+
+// Percent-encode all the bytes of s except the unreserved characters and
+// those in allow.
+func uriEscape(s, allow string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isURIUnreserved(c) || strings.IndexByte(allow, c) != -1 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xF])
+	}
+	return b.String()
+}
+
+func isURIUnreserved(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,144 @@
+package xmpp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Examples from RFC 5122 and XEP-0147.
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected URI
+	}{
+		{
+			"xmpp:romeo@montague.net",
+			URI{JID: JID{"romeo", "montague.net", ""}},
+		},
+		{
+			"xmpp://guest@example.com/support@example.com?message",
+			URI{Auth: JID{"guest", "example.com", ""}, JID: JID{"support", "example.com", ""}, Action: URIActionMessage},
+		},
+		{
+			"xmpp://guest@example.com",
+			URI{Auth: JID{"guest", "example.com", ""}},
+		},
+		{
+			"xmpp:romeo@montague.net?message;subject=Test%20Message;body=Here%27s%20a%20test%20message",
+			URI{
+				JID:    JID{"romeo", "montague.net", ""},
+				Action: URIActionMessage,
+				Params: []URIParam{{"subject", "Test Message"}, {"body", "Here's a test message"}},
+			},
+		},
+		{
+			"xmpp:darkcave@chat.shakespeare.lit?join;password=cauldronburn",
+			URI{JID: JID{"darkcave", "chat.shakespeare.lit", ""}, Action: URIActionJoin, Params: []URIParam{{"password", "cauldronburn"}}},
+		},
+		{
+			"xmpp:romeo@montague.net?subscribe",
+			URI{JID: JID{"romeo", "montague.net", ""}, Action: URIActionSubscribe},
+		},
+		{
+			"xmpp:romeo@montague.net?roster;name=Romeo%20Montague;group=Friends;group=Family",
+			URI{
+				JID:    JID{"romeo", "montague.net", ""},
+				Action: URIActionRoster,
+				Params: []URIParam{{"name", "Romeo Montague"}, {"group", "Friends"}, {"group", "Family"}},
+			},
+		},
+		{
+			"xmpp:pubsub.shakespeare.lit?pubsub;action=subscribe;node=princely_musings#item1",
+			URI{
+				JID:      JID{"", "pubsub.shakespeare.lit", ""},
+				Action:   URIActionPubSub,
+				Params:   []URIParam{{"action", "subscribe"}, {"node", "princely_musings"}},
+				Fragment: "item1",
+			},
+		},
+		{
+			"xmpp:nasty!%23$%25()*+,-.;=%3F%5B%5C%5D%5E_%60%7B%7C%7D~node@example.com",
+			URI{JID: JID{"nasty!#$%()*+,-.;=?[\\]^_`{|}~node", "example.com", ""}},
+		},
+		{
+			"xmpp:node@example.com/repulsive%20!%23%22$%25&'()*+,-.%2F:;%3C=%3E%3F%40%5B%5C%5D%5E_%60%7B%7C%7D~resource",
+			URI{JID: JID{"node", "example.com", "repulsive !#\"$%&'()*+,-./:;<=>?@[\\]^_`{|}~resource"}},
+		},
+		{
+			"xmpp:ji%C5%99i@%C4%8Dechy.example/v%20Praze",
+			URI{JID: JID{"jiři", "čechy.example", "v Praze"}},
+		},
+		{
+			"XMPP:Romeo@Montague.net",
+			URI{JID: JID{"romeo", "montague.net", ""}},
+		},
+	}
+	for _, test := range tests {
+		u, err := ParseURI(test.s)
+		if err != nil {
+			t.Errorf("%s: %v", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(*u, test.expected) {
+			t.Errorf("%s: expected %#v, got %#v", test.s, test.expected, *u)
+		}
+
+		// Generating the URI must give a URI that parses to the same thing.
+		u2, err := ParseURI(u.String())
+		if err != nil {
+			t.Errorf("%s: %v", u.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(u, u2) {
+			t.Errorf("%s: round trip gave %s", test.s, u.String())
+		}
+	}
+}
+
+func TestParseURIInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"mailto:romeo@montague.net",
+		"xmpp:",
+		"xmpp:romeo@",
+		"xmpp:romeo@montague.net?",
+		"xmpp:romeo@montague.net?message;=body",
+		"xmpp:romeo@montague.net?message;body=%zz",
+		"xmpp://guest@example.com%2Fres/romeo@montague.net",
+		"xmpp:%zz@montague.net",
+	}
+	for _, s := range tests {
+		if u, err := ParseURI(s); !errors.Is(err, ErrInvalidURI) {
+			t.Errorf("%q: expected error, got %#v, %v", s, u, err)
+		}
+	}
+}
+
+func TestURIString(t *testing.T) {
+	u := &URI{JID: MustParseJID("romeo@montague.net"), Action: URIActionMessage}
+	u.AddParam("body", "Hi & bye; 100%")
+	if s := u.String(); s != "xmpp:romeo@montague.net?message;body=Hi%20%26%20bye%3B%20100%25" {
+		t.Errorf("unexpected URI: %s", s)
+	}
+	u = &URI{JID: MustParseJID("jiři@čechy.example/v Praze")}
+	if s := u.String(); s != "xmpp:ji%C5%99i@%C4%8Dechy.example/v%20Praze" {
+		t.Errorf("unexpected URI: %s", s)
+	}
+	u = &URI{Auth: MustParseJID("guest@example.com"), JID: MustParseJID("support@example.com"), Action: URIActionJoin}
+	if s := u.String(); s != "xmpp://guest@example.com/support@example.com?join" {
+		t.Errorf("unexpected URI: %s", s)
+	}
+
+	// Parameters without an action survive a round trip.
+	u = &URI{JID: MustParseJID("romeo@montague.net"), Params: []URIParam{{"body", "hi"}}}
+	if s := u.String(); s != "xmpp:romeo@montague.net?;body=hi" {
+		t.Errorf("unexpected URI: %s", s)
+	} else if parsed, err := ParseURI(s); err != nil || !reflect.DeepEqual(parsed, u) {
+		t.Errorf("%s: unexpected round trip: %#v, %v", s, parsed, err)
+	}
+
+	if groups := (&URI{Params: []URIParam{{"group", "a"}, {"name", "b"}, {"group", "c"}}}).ParamValues("group"); !reflect.DeepEqual(groups, []string{"a", "c"}) {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+}
@@ -5,7 +5,8 @@ import (
 )
 
 const (
-	NSVCardTemp = "vcard-temp"
+	NSVCardTemp   = "vcard-temp"
+	NSVCardUpdate = "vcard-temp:x:update"
 )
 
 // XEP-0054 vCard
@@ -13,3 +14,13 @@ type VCard struct {
 	XMLName xml.Name `xml:"vcard-temp vCard"`
 	// TODO Must complete truct
 }
+
+// XEP-0153: vCard-Based Avatars
+
+// Avatar advertised in presence. Photo is the hex SHA-1 hash of the avatar
+// image, "" if there is no avatar, or nil if the client is not yet ready to
+// advertise one.
+type VCardUpdate struct {
+	XMLName xml.Name `xml:"vcard-temp:x:update x"`
+	Photo   *string  `xml:"photo"`
+}
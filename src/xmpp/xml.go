@@ -2,73 +2,254 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
 )
 
-type nsMap map[string]string
+// Namespace used for namespace declaration attributes, e.g. xmlns:stream.
+const nsXMLNS = "xmlns"
 
-// Write an xml.StartElement.
-func writeXMLStartElement(w io.Writer, start *xml.StartElement) error {
-	if _, err := w.Write([]byte{'<'}); err != nil {
-		return err
+// Writes XML tags, tracking the prefix bindings of the open elements so
+// element and attribute names are written with the correct prefix, or no
+// prefix, for their namespace.
+//
+// Names are expected to be in the form produced by xml.Decoder, i.e. with the
+// namespace URI in Space. Namespace declarations are attributes named
+// {"xmlns", prefix}, or {"", "xmlns"} for the default namespace. The xml
+// prefix is always bound to the XML namespace, so xml:lang may be given as
+// {nsXML, "lang"} or {"xml", "lang"}.
+//
+// An element whose namespace is not in scope is written with a default
+// namespace declaration. An attribute whose namespace is not in scope is
+// written with a generated prefix.
+type xmlWriter struct {
+	w io.Writer
+
+	// Open elements, innermost last.
+	scopes []xmlScope
+
+	// Number of prefixes generated so far.
+	generated int
+}
+
+// An open element and the namespace bindings it declared.
+type xmlScope struct {
+	name     xml.Name
+	qname    string
+	prefixes map[string]string // Prefix to namespace.
+	space    *string           // Default namespace, if declared.
+}
+
+func newXMLWriter(w io.Writer) *xmlWriter {
+	return &xmlWriter{w: w}
+}
+
+// Return the namespace bound to the prefix, "" for the default namespace.
+func (xw *xmlWriter) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for i := len(xw.scopes) - 1; i >= 0; i-- {
+		scope := xw.scopes[i]
+		if prefix == "" {
+			if scope.space != nil {
+				return *scope.space, true
+			}
+			continue
+		}
+		if space, ok := scope.prefixes[prefix]; ok {
+			return space, true
+		}
+	}
+	return "", prefix == ""
+}
+
+// Return a prefix currently bound to the namespace.
+func (xw *xmlWriter) prefix(space string) (string, bool) {
+	if space == nsXML || space == "xml" {
+		return "xml", true
+	}
+	for i := len(xw.scopes) - 1; i >= 0; i-- {
+		for prefix, s := range xw.scopes[i].prefixes {
+			if s != space {
+				continue
+			}
+			// Check the prefix hasn't been rebound by an inner element.
+			if bound, _ := xw.lookup(prefix); bound == space {
+				return prefix, true
+			}
+		}
 	}
-	if err := writeXMLName(w, start.Name); err != nil {
+	return "", false
+}
+
+// Write the element's start tag and open a new scope for its namespace
+// declarations.
+func (xw *xmlWriter) StartElement(start xml.StartElement) error {
+	if err := checkXMLName(start.Name.Local); err != nil {
 		return err
 	}
+
+	// The new scope's declarations are in effect for the element's own name
+	// and attributes.
+	scope := xmlScope{name: start.Name, prefixes: make(map[string]string)}
+	var attrs, decls []xml.Attr
 	for _, attr := range start.Attr {
-		if _, err := w.Write([]byte{' '}); err != nil {
-			return err
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == nsXMLNS:
+			space := attr.Value
+			scope.space = &space
+			decls = append(decls, attr)
+		case attr.Name.Space == nsXMLNS:
+			if err := checkXMLName(attr.Name.Local); err != nil {
+				return err
+			}
+			if attr.Name.Local == "xml" || attr.Name.Local == nsXMLNS || attr.Value == "" {
+				return fmt.Errorf("xml: invalid namespace declaration %s=%q", attr.Name.Local, attr.Value)
+			}
+			scope.prefixes[attr.Name.Local] = attr.Value
+			decls = append(decls, attr)
+		default:
+			attrs = append(attrs, attr)
 		}
-		if err := writeXMLAttr(w, attr); err != nil {
+	}
+	xw.scopes = append(xw.scopes, scope)
+	current := &xw.scopes[len(xw.scopes)-1]
+
+	// Qualify the element name, declaring its namespace as the default if
+	// it's not already in scope.
+	qname := start.Name.Local
+	if space, _ := xw.lookup(""); space != start.Name.Space {
+		if prefix, ok := xw.prefix(start.Name.Space); ok && start.Name.Space != "" && prefix != "xml" {
+			qname = prefix + ":" + qname
+		} else {
+			space := start.Name.Space
+			current.space = &space
+			decls = append(decls, xml.Attr{Name: xml.Name{Local: nsXMLNS}, Value: space})
+		}
+	}
+	current.qname = qname
+
+	// Qualify the attribute names, generating prefixes for namespaces that
+	// are not in scope. Unprefixed attributes are in no namespace, not the
+	// default namespace.
+	names := make([]string, len(attrs))
+	for i, attr := range attrs {
+		if err := checkXMLName(attr.Name.Local); err != nil {
+			xw.scopes = xw.scopes[:len(xw.scopes)-1]
 			return err
 		}
+		names[i] = attr.Name.Local
+		if attr.Name.Space == "" {
+			continue
+		}
+		prefix, ok := xw.prefix(attr.Name.Space)
+		if !ok {
+			for {
+				xw.generated++
+				prefix = "ns" + strconv.Itoa(xw.generated)
+				if _, bound := xw.lookup(prefix); !bound {
+					break
+				}
+			}
+			current.prefixes[prefix] = attr.Name.Space
+			decls = append(decls, xml.Attr{Name: xml.Name{Space: nsXMLNS, Local: prefix}, Value: attr.Name.Space})
+		}
+		names[i] = prefix + ":" + attr.Name.Local
 	}
-	if _, err := w.Write([]byte{'>'}); err != nil {
+
+	if _, err := io.WriteString(xw.w, "<"+qname); err != nil {
 		return err
 	}
-	return nil
+	for _, decl := range decls {
+		name := nsXMLNS
+		if decl.Name.Space == nsXMLNS {
+			name += ":" + decl.Name.Local
+		}
+		if err := xw.writeAttr(name, decl.Value); err != nil {
+			return err
+		}
+	}
+	for i, attr := range attrs {
+		if err := xw.writeAttr(names[i], attr.Value); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(xw.w, ">")
+	return err
 }
 
-// Write an xml.StartElement.
-func writeXMLEndElement(w io.Writer, end *xml.EndElement) error {
-	if _, err := w.Write([]byte{'<', '/'}); err != nil {
-		return err
+// Write the end tag of the innermost open element, which must match end.
+func (xw *xmlWriter) EndElement(end xml.EndElement) error {
+	if len(xw.scopes) == 0 {
+		return fmt.Errorf("xml: end tag </%s> without start tag", end.Name.Local)
 	}
-	if err := writeXMLName(w, end.Name); err != nil {
-		return err
+	scope := xw.scopes[len(xw.scopes)-1]
+	if end.Name != scope.name {
+		return fmt.Errorf("xml: end tag </%s> does not match start tag <%s>", end.Name.Local, scope.name.Local)
 	}
-	if _, err := w.Write([]byte{'>'}); err != nil {
-		return err
+	xw.scopes = xw.scopes[:len(xw.scopes)-1]
+	_, err := io.WriteString(xw.w, "</"+scope.qname+">")
+	return err
+}
+
+// Write the token, which must be a StartElement, EndElement or CharData.
+func (xw *xmlWriter) WriteToken(tok xml.Token) error {
+	switch tok := tok.(type) {
+	case xml.StartElement:
+		return xw.StartElement(tok)
+	case xml.EndElement:
+		return xw.EndElement(tok)
+	case xml.CharData:
+		return xml.EscapeText(xw.w, tok)
 	}
-	return nil
+	return fmt.Errorf("xml: unsupported token %T", tok)
 }
 
-// Write a xml.Name.
-func writeXMLName(w io.Writer, name xml.Name) error {
-	if name.Space == "" {
-		if _, err := fmt.Fprintf(w, name.Local); err != nil {
-			return err
-		}
-	} else {
-		if _, err := fmt.Fprintf(w, "%s:%s", name.Space, name.Local); err != nil {
+// Write the end tags of all the open elements.
+func (xw *xmlWriter) Close() error {
+	for len(xw.scopes) > 0 {
+		if err := xw.EndElement(xml.EndElement{Name: xw.scopes[len(xw.scopes)-1].name}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Write a xml.Attr.
-func writeXMLAttr(w io.Writer, attr xml.Attr) error {
-	if err := writeXMLName(w, attr.Name); err != nil {
+func (xw *xmlWriter) writeAttr(name, value string) error {
+	if _, err := io.WriteString(xw.w, " "+name+"='"); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte{'=', '\''}); err != nil {
+	if err := xml.EscapeText(xw.w, []byte(value)); err != nil {
 		return err
 	}
-	xml.Escape(w, []byte(attr.Value))
-	if _, err := w.Write([]byte{'\''}); err != nil {
-		return err
+	_, err := io.WriteString(xw.w, "'")
+	return err
+}
+
+var errInvalidXMLName = errors.New("xml: invalid name")
+
+// Check the name is a valid, unprefixed XML name so it can't be used to
+// inject markup.
+func checkXMLName(name string) error {
+	if name == "" {
+		return errInvalidXMLName
+	}
+	for i, r := range name {
+		if r == utf8.RuneError || r == ':' {
+			return fmt.Errorf("%w %q", errInvalidXMLName, name)
+		}
+		if unicode.IsLetter(r) || r == '_' {
+			continue
+		}
+		if i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.' || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r)) {
+			continue
+		}
+		return fmt.Errorf("%w %q", errInvalidXMLName, name)
 	}
 	return nil
 }
@@ -3,37 +3,193 @@ package xmpp
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
 )
 
-func TestWriteNameLocal(t *testing.T) {
-	buf := new(bytes.Buffer)
-	writeXMLName(buf, xml.Name{"", "foo"})
-	if buf.String() != "foo" {
-		t.Fail()
+func TestXMLWriterStartElement(t *testing.T) {
+	tests := []struct {
+		start    xml.StartElement
+		expected string
+	}{
+		{
+			xml.StartElement{Name: xml.Name{"", "foo"}},
+			"<foo>",
+		},
+		{
+			xml.StartElement{Name: xml.Name{"space", "foo"}},
+			"<foo xmlns='space'>",
+		},
+		{
+			xml.StartElement{Name: xml.Name{"", "foo"}, Attr: []xml.Attr{{xml.Name{"", "bar"}, "a<'&"}}},
+			"<foo bar='a&lt;&#39;&amp;'>",
+		},
+		{
+			xml.StartElement{Name: xml.Name{"", "foo"}, Attr: []xml.Attr{{xml.Name{"space", "bar"}, "baz"}}},
+			"<foo xmlns:ns1='space' ns1:bar='baz'>",
+		},
+		{
+			xml.StartElement{Name: xml.Name{"", "foo"}, Attr: []xml.Attr{{xml.Name{nsXML, "lang"}, "en"}}},
+			"<foo xml:lang='en'>",
+		},
+		{
+			xml.StartElement{Name: xml.Name{"", "foo"}, Attr: []xml.Attr{{xml.Name{"xml", "lang"}, "en"}}},
+			"<foo xml:lang='en'>",
+		},
+		{
+			xml.StartElement{
+				Name: xml.Name{nsStreams, "stream"},
+				Attr: []xml.Attr{
+					{xml.Name{"", "xmlns"}, nsClient},
+					{xml.Name{"xmlns", "stream"}, nsStreams},
+					{xml.Name{"", "to"}, "example.com"},
+				},
+			},
+			"<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' to='example.com'>",
+		},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if err := newXMLWriter(buf).StartElement(test.start); err != nil {
+			t.Errorf("%v: %v", test.start, err)
+			continue
+		}
+		if buf.String() != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, buf.String())
+		}
 	}
 }
 
-func TestWriteName(t *testing.T) {
+func TestXMLWriterScopes(t *testing.T) {
 	buf := new(bytes.Buffer)
-	writeXMLName(buf, xml.Name{"space", "foo"})
-	if buf.String() != "space:foo" {
-		t.Fail()
+	xw := newXMLWriter(buf)
+	stream := xml.Name{nsStreams, "stream"}
+	tokens := []xml.Token{
+		xml.StartElement{Name: stream, Attr: []xml.Attr{{xml.Name{"xmlns", "stream"}, nsStreams}}},
+		xml.StartElement{Name: xml.Name{nsStreams, "features"}},
+		xml.StartElement{Name: xml.Name{nsTLS, "starttls"}},
+		xml.CharData("<>"),
+		xml.EndElement{Name: xml.Name{nsTLS, "starttls"}},
+		xml.EndElement{Name: xml.Name{nsStreams, "features"}},
+	}
+	for _, tok := range tokens {
+		if err := xw.WriteToken(tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xw.EndElement(xml.EndElement{Name: xml.Name{nsTLS, "starttls"}}); err == nil {
+		t.Error("expected error for mismatched end element")
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "<stream:stream xmlns:stream='http://etherx.jabber.org/streams'>" +
+		"<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'>&lt;&gt;</starttls></stream:features>" +
+		"</stream:stream>"
+	if buf.String() != expected {
+		t.Errorf("expected %s, got %s", expected, buf.String())
 	}
 }
 
-func TestWriteAttrLocal(t *testing.T) {
-	buf := new(bytes.Buffer)
-	writeXMLAttr(buf, xml.Attr{xml.Name{"", "foo"}, "bar"})
-	if buf.String() != "foo='bar'" {
-		t.Fail()
+func TestXMLWriterInvalidName(t *testing.T) {
+	names := []string{"", "foo bar", "foo><bar", "foo:bar", "1foo", "foo'"}
+	for _, name := range names {
+		buf := new(bytes.Buffer)
+		xw := newXMLWriter(buf)
+		if err := xw.StartElement(xml.StartElement{Name: xml.Name{"", name}}); !errors.Is(err, errInvalidXMLName) {
+			t.Errorf("%q: expected invalid name error, got %v", name, err)
+		}
+		attr := xml.Attr{Name: xml.Name{"", name}, Value: "x"}
+		if err := xw.StartElement(xml.StartElement{Name: xml.Name{"", "foo"}, Attr: []xml.Attr{attr}}); !errors.Is(err, errInvalidXMLName) {
+			t.Errorf("%q: expected invalid attribute name error, got %v", name, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%q: unexpected output %s", name, buf.String())
+		}
 	}
 }
 
-func TestWriteAttr(t *testing.T) {
-	buf := new(bytes.Buffer)
-	writeXMLAttr(buf, xml.Attr{xml.Name{"space", "foo"}, "bar"})
-	if buf.String() != "space:foo='bar'" {
-		t.Fail()
+func TestXMLRoundTrip(t *testing.T) {
+	docs := []string{
+		"<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' xml:lang='en'>" +
+			"<message to='a@b' xml:lang='de'><body>Hallo &amp; tsch&#252;ss</body><body xml:lang='en'>Hi</body></message>" +
+			"<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls></stream:features>" +
+			"</stream:stream>",
+		"<a:foo xmlns:a='urn:a' xmlns:b='urn:b' b:attr='1'><b:bar a:attr='2'><a:baz xmlns:a='urn:c'/></b:bar></a:foo>",
+		"<foo xmlns='urn:a'><bar xmlns=''><baz xmlns='urn:b' attr='x'/></bar></foo>",
+	}
+	for _, doc := range docs {
+		expected := readXMLTokens(t, doc)
+		buf := new(bytes.Buffer)
+		xw := newXMLWriter(buf)
+		for _, tok := range expected {
+			if err := xw.WriteToken(tok); err != nil {
+				t.Fatalf("%s: %v", doc, err)
+			}
+		}
+		actual := readXMLTokens(t, buf.String())
+		if !reflect.DeepEqual(stripXMLNS(expected), stripXMLNS(actual)) {
+			t.Errorf("round trip failed:\n%s\n%s", doc, buf.String())
+		}
+	}
+}
+
+func TestStanzaLang(t *testing.T) {
+	in := "<message xmlns='jabber:client' xml:lang='de'><body>Hallo</body><body xml:lang='en'>Hello</body></message>"
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(in), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Lang != "de" || len(msg.Body) != 2 || msg.Body[1].Lang != "en" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	out, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `xml:lang="de"`) || !strings.Contains(string(out), `<body xml:lang="en">`) {
+		t.Errorf("unexpected xml: %s", out)
+	}
+}
+
+// Read all the element and character data tokens of the document.
+func readXMLTokens(t *testing.T, doc string) []xml.Token {
+	dec := xml.NewDecoder(strings.NewReader(doc))
+	var tokens []xml.Token
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return tokens
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", doc, err)
+		}
+		switch tok.(type) {
+		case xml.StartElement, xml.EndElement, xml.CharData:
+			tokens = append(tokens, xml.CopyToken(tok))
+		}
+	}
+}
+
+// Remove the namespace declarations, which may legitimately differ, from the
+// start elements.
+func stripXMLNS(tokens []xml.Token) []xml.Token {
+	stripped := make([]xml.Token, len(tokens))
+	for i, tok := range tokens {
+		if start, ok := tok.(xml.StartElement); ok {
+			var attrs []xml.Attr
+			for _, attr := range start.Attr {
+				if attr.Name.Space != "xmlns" && attr.Name != (xml.Name{"", "xmlns"}) {
+					attrs = append(attrs, attr)
+				}
+			}
+			start.Attr = attrs
+			tok = start
+		}
+		stripped[i] = tok
 	}
+	return stripped
 }
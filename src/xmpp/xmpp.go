@@ -1,16 +1,27 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
+// Returned when sending, or waiting for, a stanza fails because the stream
+// is closed.
+var ErrStreamClosed = errors.New("xmpp: stream closed")
+
+// Default time Close waits for the remote server to close its stream.
+const DefaultCloseTimeout = 5 * time.Second
+
 // Handles XMPP conversations over a Stream. Use NewClientXMPP or
 // NewComponentXMPP to create and configure a XMPP instance.
-// Close the conversation by closing the Out channel, the In channel will be
-// closed when the remote server closes its stream.
+// Close the conversation by calling Close or closing the Out channel. The In
+// channel is closed when the remote server closes its stream or the
+// conversation is closed.
 type XMPP struct {
 
 	// JID associated with the stream. Note: this may be negotiated with the
@@ -20,45 +31,203 @@ type XMPP struct {
 
 	// Channel of incoming messages. Values will be one of IQ, Message,
 	// Presence, Error or error. Will be closed at the end when the stream is
-	// closed or the stream's net connection dies.
+	// closed or the stream's net connection dies. Anything received once Close
+	// has been called may be dropped.
 	In chan interface{}
 
 	// Channel of outgoing messages. Messages must be able to be marshaled by
 	// the standard xml package, however you should try to send one of IQ,
-	// Message or Presence.
+	// Message or Presence. Errors are logged; use Send to find out if a
+	// message was written successfully. Out is never closed by the XMPP
+	// instance, so writing to it never panics, but messages written once
+	// Close has been called are discarded; Send returns ErrStreamClosed
+	// instead. Closing Out closes the conversation.
 	Out chan interface{}
 
+	// Stream features the server advertised once the stream was negotiated.
+	// nil for components.
+	features *features
+
 	// Incoming stanza filters.
 	filterLock   sync.Mutex
 	nextFilterID FilterID
-	filters      []filter
+	filters      []*filter
+	filtersDone  bool
+
+	// Closed when the receiver stops, i.e. the stream has ended or its net
+	// connection has died.
+	recvDone chan struct{}
+
+	// Outgoing data, written to the stream by the writer.
+	queue *sendQueue
+
+	// Conversation shutdown. closing is closed when Close starts, shutdown
+	// once the net connection is being torn down and done when everything's
+	// closed.
+	closeOnce sync.Once
+	closeErr  error
+	closing   chan struct{}
+	shutdown  chan struct{}
+	done      chan struct{}
 }
 
 func newXMPP(jid JID, stream *Stream) *XMPP {
 	x := &XMPP{
-		JID:    jid,
-		stream: stream,
-		In:     make(chan interface{}),
-		Out:    make(chan interface{}),
+		JID:      jid,
+		stream:   stream,
+		In:       make(chan interface{}),
+		Out:      make(chan interface{}),
+		recvDone: make(chan struct{}),
+		queue:    newSendQueue(stream.config.Queue),
+		closing:  make(chan struct{}),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
 	}
+	go x.writer()
 	go x.sender()
 	go x.receiver()
 	return x
 }
 
+// Send a stanza and wait until it's been written to the stream. v must be
+// able to be marshaled by the standard xml package. The stanza is queued
+// behind any higher priority output and is subject to the stream's rate
+// limit, see QueueConfig. Returns ErrStreamClosed once the conversation is
+// closing.
+func (x *XMPP) Send(ctx context.Context, v interface{}) error {
+	req := x.sendReq(v)
+	req.err = make(chan error, 1)
+	if err := x.enqueue(ctx, req); err != nil {
+		return err
+	}
+	return x.wait(ctx, req)
+}
+
+// Create a request to write the stanza.
+func (x *XMPP) sendReq(v interface{}) *sendReq {
+	v = withDefaultLang(v, x.stream.SendLang())
+	priority := x.queue.priority(v)
+	if priority < PriorityBulk || priority > PriorityHigh {
+		priority = PriorityNormal
+	}
+	return &sendReq{
+		fn:       func() error { return x.stream.Encode(v) },
+		priority: priority,
+	}
+}
+
+// Add the request to the outgoing queue, unless the conversation is closing.
+func (x *XMPP) enqueue(ctx context.Context, req *sendReq) error {
+	select {
+	case <-x.closing:
+		return ErrStreamClosed
+	default:
+	}
+	return x.queue.push(ctx, req, x.shutdown)
+}
+
+// Wait for the result of writing a queued request.
+func (x *XMPP) wait(ctx context.Context, req *sendReq) error {
+	select {
+	case err := <-req.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Return a snapshot of the outgoing queue's metrics.
+func (x *XMPP) QueueStats() QueueStats {
+	return x.queue.snapshot()
+}
+
+// Return a channel that's closed once the conversation is over, i.e. the
+// stream is closed, the net connection released and all channels closed.
+func (x *XMPP) Done() <-chan struct{} {
+	return x.done
+}
+
+// Send an IQ request and wait for the response. The response is returned
+// as-is, i.e. the caller must check the response's Error for an
+// <iq type="error"/> reply. Waiting stops if the stream closes.
 func (x *XMPP) SendRecv(iq *IQ) (*IQ, error) {
+	return x.sendRecv(context.Background(), iq)
+}
+
+// Send an IQ request and wait for the response. The request is given a new ID
+// if it doesn't already have one.
+//
+// Waiting stops with ctx.Err() if the context is cancelled or its deadline
+// passes, or with ErrStreamClosed if the stream closes first. An
+// <iq type="error"/> response is returned as an *IQError, wrapping the
+// response's *Error.
+func (x *XMPP) SendRecvContext(ctx context.Context, iq *IQ) (*IQ, error) {
+	reply, err := x.sendRecv(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type == IQTypeError {
+		return reply, newIQError(reply)
+	}
+	return reply, nil
+}
+
+func (x *XMPP) sendRecv(ctx context.Context, iq *IQ) (*IQ, error) {
 
-	fid, ch := x.AddFilter(IQResult(iq.ID))
+	if iq.ID == "" {
+		iq.ID = UUID4()
+	}
+
+	fid, ch := x.AddFilter(IQResponse(iq, x.JID))
 	defer x.RemoveFilter(fid)
 
-	x.Out <- iq
+	if err := x.Send(ctx, iq); err != nil {
+		return nil, err
+	}
 
-	stanza := <-ch
-	reply, ok := stanza.(*IQ)
-	if !ok {
-		return nil, fmt.Errorf("Expected IQ, for %T", stanza)
+	select {
+	case stanza, ok := <-ch:
+		if !ok {
+			return nil, ErrStreamClosed
+		}
+		reply, ok := stanza.(*IQ)
+		if !ok {
+			return nil, fmt.Errorf("Expected IQ, for %T", stanza)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-x.recvDone:
+		return nil, ErrStreamClosed
 	}
-	return reply, nil
+}
+
+// Error returned by SendRecvContext for an <iq type="error"/> response.
+// Unwraps to the response's *Error so errors.As can be used to inspect the
+// error condition.
+type IQError struct {
+	// The error response.
+	Response *IQ
+
+	// The response's error element.
+	Err *Error
+}
+
+func newIQError(iq *IQ) *IQError {
+	err := iq.Error
+	if err == nil {
+		// Not a valid error response but report it as an error anyway.
+		err = NewError("cancel", ErrorUndefinedCondition, "")
+	}
+	return &IQError{Response: iq, Err: err}
+}
+
+func (e *IQError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *IQError) Unwrap() error {
+	return e.Err
 }
 
 // Interface used to test if a stanza matches some application-defined
@@ -85,16 +254,48 @@ func (fid FilterID) Error() string {
 	return fmt.Sprintf("Invalid filter id: %d", fid)
 }
 
+// Controls how stanzas matched by a filter are shared with the other filters
+// and the In channel.
+type FilterMode int
+
+const (
+	// Matching stanzas are delivered to every matching shared filter but not
+	// to the In channel. This is the mode used by AddFilter.
+	FilterShared FilterMode = iota
+
+	// Matching stanzas are delivered to this filter only. Exclusive filters
+	// are tried before all other filters, most recently added first.
+	FilterExclusive
+
+	// A copy of each matching stanza is delivered to the filter. The stanza
+	// itself continues on to the other filters and the In channel as if the
+	// filter had not matched.
+	FilterCopy
+)
+
 type filter struct {
-	id FilterID
-	m  Matcher
-	ch chan interface{}
+	id   FilterID
+	m    Matcher
+	mode FilterMode
+	ch   chan interface{}
+
+	// Closed when the filter is removed to abandon any pending delivery.
+	done chan struct{}
+
+	// Held while delivering to ch so it's not closed mid-send.
+	lock sync.Mutex
 }
 
 // Add a filter that routes matching stanzas to the returned channel. A
 // FilterID is also returned and can be pased to RemoveFilter to remove the
 // filter again.
 func (x *XMPP) AddFilter(m Matcher) (FilterID, chan interface{}) {
+	return x.AddFilterMode(m, FilterShared)
+}
+
+// Add a filter, as AddFilter, that shares matching stanzas according to the
+// mode.
+func (x *XMPP) AddFilterMode(m Matcher, mode FilterMode) (FilterID, chan interface{}) {
 
 	// Protect against concurrent access.
 	x.filterLock.Lock()
@@ -105,9 +306,15 @@ func (x *XMPP) AddFilter(m Matcher) (FilterID, chan interface{}) {
 	id := x.nextFilterID
 	x.nextFilterID++
 
+	// Nothing more will be received once the conversation is closed.
+	if x.filtersDone {
+		close(ch)
+		return id, ch
+	}
+
 	// Insert at head of filters list.
-	filters := make([]filter, len(x.filters)+1)
-	filters[0] = filter{id, m, ch}
+	filters := make([]*filter, len(x.filters)+1)
+	filters[0] = &filter{id: id, m: m, mode: mode, ch: ch, done: make(chan struct{})}
 	copy(filters[1:], x.filters)
 	x.filters = filters
 
@@ -127,15 +334,18 @@ func (x *XMPP) RemoveFilter(id FilterID) error {
 			continue
 		}
 
-		// Close the channel.
-		close(f.ch)
-
 		// Remove from list.
-		filters := make([]filter, len(x.filters)-1)
+		filters := make([]*filter, len(x.filters)-1)
 		copy(filters, x.filters[:i])
 		copy(filters[i:], x.filters[i+1:])
 		x.filters = filters
 
+		// Abandon any delivery in progress and close the channel.
+		close(f.done)
+		f.lock.Lock()
+		close(f.ch)
+		f.lock.Unlock()
+
 		return nil
 	}
 
@@ -143,8 +353,10 @@ func (x *XMPP) RemoveFilter(id FilterID) error {
 	return id
 }
 
-// Matcher to identify a <iq id="..." type="result" /> stanza with the given
-// id.
+// Matcher to identify a <iq id="..." type="result|error" /> stanza with the
+// given id. Note: the sender is not checked so any entity that knows, or
+// guesses, the id can forge a response. Use IQResponse to match replies to a
+// request.
 func IQResult(id string) Matcher {
 	return MatcherFunc(
 		func(v interface{}) bool {
@@ -155,16 +367,113 @@ func IQResult(id string) Matcher {
 			if iq.ID != id {
 				return false
 			}
-			return true
+			return iq.Type == IQTypeResult || iq.Type == IQTypeError
+		},
+	)
+}
+
+// Matcher to identify the response to the IQ request, req, sent from the
+// account. A <iq type="result|error"/> stanza matches if it has the request's
+// id and comes from the entity the request was addressed to.
+//
+// A request without a 'to' is handled by the account's server on behalf of
+// the account. As per RFC 6120 the response from the server may have no
+// 'from' or the account's bare JID as 'from' and both are treated the same.
+func IQResponse(req *IQ, account JID) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok {
+				return false
+			}
+			if iq.ID != req.ID {
+				return false
+			}
+			if iq.Type != IQTypeResult && iq.Type != IQTypeError {
+				return false
+			}
+			return sameAddress(iq.From, req.To) || (isAccountAddress(account, req.To) && isAccountAddress(account, iq.From))
+		},
+	)
+}
+
+// Matcher to identify stanzas sent by the account's server on behalf of the
+// account, i.e. with no 'from' or the account's bare JID as 'from'. Use this
+// to check that server-originated requests such as roster pushes are genuine.
+func FromAccount(account JID) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			from, ok := stanzaFrom(v)
+			if !ok {
+				return false
+			}
+			return isAccountAddress(account, from)
 		},
 	)
 }
 
+// Test if the address refers to the account itself, i.e. is empty or the
+// account's bare JID.
+func isAccountAddress(account JID, addr string) bool {
+	if addr == "" {
+		return true
+	}
+	jid, err := ParseJID(addr)
+	return err == nil && jid.Resource == "" && jid.BareEqual(account)
+}
+
+// Test if the addresses are the same JID, after normalisation. Addresses that
+// are not valid JIDs are only the same if they're identical.
+func sameAddress(a, b string) bool {
+	if a == b {
+		return true
+	}
+	jidA, err := ParseJID(a)
+	if err != nil {
+		return false
+	}
+	jidB, err := ParseJID(b)
+	return err == nil && jidA == jidB
+}
+
+// Check that the stanza's 'to' and 'from', if present, are valid JIDs.
+func checkAddresses(v interface{}) error {
+	var to, from string
+	switch v := v.(type) {
+	case *IQ:
+		to, from = v.To, v.From
+	case *Message:
+		to, from = v.To, v.From
+	case *Presence:
+		to, from = v.To, v.From
+	}
+	if _, err := parseAddress(to); err != nil {
+		return err
+	}
+	_, err := parseAddress(from)
+	return err
+}
+
+// Return the 'from' of a stanza, or false if v is not a stanza.
+func stanzaFrom(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case *IQ:
+		return v.From, true
+	case *Message:
+		return v.From, true
+	case *Presence:
+		return v.From, true
+	}
+	return "", false
+}
+
 func (x *XMPP) sender() {
 
-	// Send outgoing elements to the stream until the channel is closed.
+	// Queue outgoing elements for the stream until the channel is closed.
 	for v := range x.Out {
-		x.stream.Send(v)
+		if err := x.enqueue(context.Background(), x.sendReq(v)); err != nil && err != ErrStreamClosed {
+			log.Println("Error. Failed to send element. ", err)
+		}
 	}
 
 	// Close the stream. Note: relies on common element name for all types of
@@ -173,18 +482,70 @@ func (x *XMPP) sender() {
 	x.Close()
 }
 
+// Maximum number of stanzas buffered before the stream is flushed.
+const maxWriteBatch = 64
+
+func (x *XMPP) writer() {
+	defer x.queue.close(ErrStreamClosed)
+
+	// Stanzas are encoded into the stream's buffer as they're dequeued and
+	// the buffer flushed once nothing more is ready to be written, coalescing
+	// bursts into as few net writes as possible. Results are reported once
+	// flushed.
+	var batch []*sendReq
+	var errs []error
+	flush := func() {
+		flushErr := x.stream.Flush()
+		for i, req := range batch {
+			err := errs[i]
+			if err == nil {
+				err = flushErr
+			}
+			if req.err != nil {
+				req.err <- err
+			} else if err != nil {
+				log.Println("Error. Failed to send element. ", err)
+			}
+		}
+		batch, errs = batch[:0], errs[:0]
+	}
+
+	ended := false
+	for {
+		req := x.queue.next(false, x.shutdown)
+		if req == nil {
+			flush()
+			req = x.queue.next(true, x.shutdown)
+			if req == nil {
+				return
+			}
+		}
+		err := ErrStreamClosed
+		if !ended {
+			err = req.fn()
+			ended = req.end
+		}
+		batch = append(batch, req)
+		errs = append(errs, err)
+		if len(batch) >= maxWriteBatch {
+			flush()
+		}
+	}
+}
+
 func (x *XMPP) receiver() {
 
 	defer func() {
 		log.Println("Close XMPP receiver")
-		x.Close()
+		close(x.recvDone)
 		close(x.In)
+		go x.Close()
 	}()
 
 	for {
 		start, err := x.stream.Next()
 		if err != nil {
-			x.In <- err
+			x.deliverIn(err)
 			return
 		}
 
@@ -200,30 +561,191 @@ func (x *XMPP) receiver() {
 			v = &Presence{}
 		default:
 			log.Printf("Error. Unexected element: %T %v", start, start)
+			if err := x.stream.Skip(); err != nil {
+				x.deliverIn(err)
+				return
+			}
+			continue
 		}
 
-		err = x.stream.Decode(v, start)
-		if err != nil {
-			log.Println("Error. Failed to decode element. ", err)
+		// A stanza with a value that can't be decoded is dropped, answering
+		// a request so the sender isn't left waiting. Any other error means
+		// the stream can't be trusted, e.g. because a limit was exceeded.
+		if err := x.stream.Decode(v, start); err != nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				log.Println("Error. Failed to decode element. ", err)
+				x.deliverIn(err)
+				return
+			}
+			log.Println("Error. Dropping stanza that failed to decode. ", err)
+			x.reject(v, ErrorBadRequest)
+			continue
 		}
 
-		filtered := false
-		for _, filter := range x.filters {
-			if filter.m.Match(v) {
-				filter.ch <- v
-				filtered = true
-			}
+		// Detect invalid addresses once, here, so handlers can rely on them.
+		if err := checkAddresses(v); err != nil {
+			log.Println("Error. Dropping stanza with invalid address. ", err)
+			x.reject(v, ErrorJIDMalformed)
+			continue
 		}
+		setDefaultLang(v, x.stream.RecvLang())
 
-		if !filtered {
-			x.In <- v
+		if !x.filter(v) {
+			x.deliverIn(v)
 		}
 	}
 }
 
-func (x *XMPP) Close() {
-	log.Println("Close XMPP")
-	x.stream.SendEnd(&xml.EndElement{xml.Name{"stream", "stream"}})
+// Answer an IQ request that's dropped by the receiver with an error. The
+// answer is sent by another goroutine, so it doesn't hold up the receiver.
+// Other stanzas aren't answered. The IQ's attributes are strings, so they're
+// known even if the IQ failed to decode, but the payload may be incomplete
+// and isn't included.
+func (x *XMPP) reject(v interface{}, condition ErrorCondition) {
+	iq, ok := v.(*IQ)
+	if !ok || (iq.Type != IQTypeGet && iq.Type != IQTypeSet) {
+		return
+	}
+	resp := iq.Response(IQTypeError)
+	resp.Error = NewError("", condition, "")
+	go func() {
+		if err := x.Send(context.Background(), resp); err != nil && err != ErrStreamClosed {
+			log.Println("Error. Failed to send IQ error. ", err)
+		}
+	}()
+}
+
+// Send v to the In channel, unless the conversation is closing. Delivery
+// must not hold up Close, which may have been called by the goroutine that
+// reads In.
+func (x *XMPP) deliverIn(v interface{}) {
+	select {
+	case x.In <- v:
+	case <-x.closing:
+	}
+}
+
+// Deliver the stanza to the matching filters. Returns true if the stanza was
+// consumed by a filter, i.e. should not be sent to the In channel.
+func (x *XMPP) filter(v interface{}) bool {
+
+	x.filterLock.Lock()
+	filters := x.filters
+	x.filterLock.Unlock()
+
+	// Exclusive filters get first pick.
+	for _, f := range filters {
+		if f.mode == FilterExclusive && f.m.Match(v) && f.deliver(v, x.shutdown) {
+			return true
+		}
+	}
+
+	filtered := false
+	for _, f := range filters {
+		if f.mode == FilterExclusive || !f.m.Match(v) {
+			continue
+		}
+		if f.mode == FilterCopy {
+			f.deliver(copyStanza(v), x.shutdown)
+		} else if f.deliver(v, x.shutdown) {
+			filtered = true
+		}
+	}
+	return filtered
 }
 
-// BUG(matt): Filter channels are not closed when the stream is closed.
+// Return a shallow copy of the stanza, or v itself if it's not a stanza.
+func copyStanza(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *IQ:
+		c := *v
+		return &c
+	case *Message:
+		c := *v
+		return &c
+	case *Presence:
+		c := *v
+		return &c
+	case *Error:
+		c := *v
+		return &c
+	}
+	return v
+}
+
+// Deliver the stanza to the filter's channel. Returns false if the filter was
+// removed, or shutdown closed, before the stanza could be delivered.
+func (f *filter) deliver(v interface{}, shutdown chan struct{}) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	select {
+	case f.ch <- v:
+		return true
+	case <-f.done:
+		return false
+	case <-shutdown:
+		return false
+	}
+}
+
+// Close the conversation. Pending output is written, the stream's closing tag
+// is sent and Close waits for the remote server to close its stream, up to the
+// stream's CloseTimeout. The net connection is then closed, as are the In
+// channel and all filter channels. Close may be called more than once, and
+// concurrently; all calls wait for the conversation to be closed.
+func (x *XMPP) Close() error {
+	x.closeOnce.Do(func() {
+		log.Println("Close XMPP")
+		close(x.closing)
+
+		timeout := x.stream.config.CloseTimeout
+		if timeout == 0 {
+			timeout = DefaultCloseTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// Written once all pending output has been written.
+		end := &sendReq{
+			fn: func() error {
+				return x.stream.SendEnd(&xml.EndElement{xml.Name{nsStreams, "stream"}})
+			},
+			end: true,
+			err: make(chan error, 1),
+		}
+		x.queue.pushEnd(end)
+		x.closeErr = x.wait(ctx, end)
+
+		// Wait for the server to close its stream.
+		select {
+		case <-x.recvDone:
+		case <-ctx.Done():
+		}
+
+		close(x.shutdown)
+		if err := x.stream.Close(); err != nil && x.closeErr == nil {
+			x.closeErr = err
+		}
+		<-x.recvDone
+
+		x.closeFilters()
+		close(x.done)
+	})
+	<-x.done
+	return x.closeErr
+}
+
+// Close and remove all filters.
+func (x *XMPP) closeFilters() {
+	x.filterLock.Lock()
+	defer x.filterLock.Unlock()
+	for _, f := range x.filters {
+		close(f.done)
+		f.lock.Lock()
+		close(f.ch)
+		f.lock.Unlock()
+	}
+	x.filters = nil
+	x.filtersDone = true
+}
@@ -0,0 +1,344 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Fake server end of a stream, used to drive an XMPP instance in tests.
+type testServer struct {
+	conn net.Conn
+	dec  *xml.Decoder
+}
+
+// Create an XMPP instance with an already open stream connected to a fake
+// server.
+func newTestXMPP(t *testing.T) (*XMPP, *testServer) {
+	client, server := net.Pipe()
+	stream := newStream(client, &StreamConfig{CloseTimeout: 100 * time.Millisecond})
+	s := &testServer{conn: server, dec: xml.NewDecoder(server)}
+	go func() {
+		s.dec.Token()
+		s.send(t, "<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>")
+	}()
+	if _, err := stream.SendStart(&xml.StartElement{
+		Name: xml.Name{Space: nsStreams, Local: "stream"},
+		Attr: []xml.Attr{{Name: xml.Name{Space: "xmlns", Local: "stream"}, Value: nsStreams}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return newXMPP(JID{"alice", "wonderland.lit", "test"}, stream), s
+}
+
+// Wait for cond to become true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Read the next IQ sent by the client. Safe to call from any goroutine.
+func (s *testServer) recvIQ(t *testing.T) *IQ {
+	iq := &IQ{}
+	if err := s.dec.Decode(iq); err != nil {
+		t.Error(err)
+	}
+	return iq
+}
+
+// Write raw XML to the client. Safe to call from any goroutine.
+func (s *testServer) send(t *testing.T, data string) {
+	if _, err := s.conn.Write([]byte(data)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendRecvContext(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='result' id='"+req.ID+"'><ping xmlns='urn:xmpp:ping'/></iq>")
+	}()
+	reply, err := x.SendRecvContext(context.Background(), &IQ{Type: IQTypeGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != IQTypeResult || reply.PayloadName().Space != NSPing {
+		t.Errorf("unexpected reply: %v", reply)
+	}
+}
+
+func TestSendRecvContextError(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='error' id='"+req.ID+"'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>")
+	}()
+	_, err := x.SendRecvContext(context.Background(), &IQ{Type: IQTypeGet})
+	var iqErr *IQError
+	if !errors.As(err, &iqErr) {
+		t.Fatalf("expected *IQError, got %v", err)
+	}
+	var stanzaErr *Error
+	if !errors.As(err, &stanzaErr) || stanzaErr.Condition().Local != "item-not-found" {
+		t.Errorf("expected item-not-found, got %v", err)
+	}
+}
+
+func TestSendRecvContextTimeout(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go s.recvIQ(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := x.SendRecvContext(ctx, &IQ{Type: IQTypeGet}); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	x.filterLock.Lock()
+	defer x.filterLock.Unlock()
+	if len(x.filters) != 0 {
+		t.Errorf("filter not removed")
+	}
+}
+
+func TestSendRecvContextClosed(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		for range x.In {
+		}
+	}()
+	go func() {
+		s.recvIQ(t)
+		s.conn.Close()
+	}()
+	if _, err := x.SendRecvContext(context.Background(), &IQ{Type: IQTypeGet}); err != ErrStreamClosed {
+		t.Fatalf("expected ErrStreamClosed, got %v", err)
+	}
+}
+
+func TestSendRecvContextSpoofed(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		for range x.In {
+		}
+	}()
+	go func() {
+		req := s.recvIQ(t)
+		s.send(t, "<iq type='result' id='"+req.ID+"' from='mallory@evil.lit'/>")
+		s.send(t, "<iq type='set' id='"+req.ID+"' from='rabbit@wonderland.lit'/>")
+		s.send(t, "<iq type='result' id='"+req.ID+"' from='rabbit@wonderland.lit'/>")
+	}()
+	reply, err := x.SendRecvContext(context.Background(), &IQ{Type: IQTypeGet, To: "rabbit@wonderland.lit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.From != "rabbit@wonderland.lit" || reply.Type != IQTypeResult {
+		t.Errorf("matched wrong reply: %v", reply)
+	}
+}
+
+func TestIQResponseFromAccount(t *testing.T) {
+	account := JID{"alice", "wonderland.lit", "test"}
+	req := &IQ{ID: "1", Type: IQTypeGet}
+	tests := []struct {
+		from  string
+		match bool
+	}{
+		{"", true},
+		{"alice@wonderland.lit", true},
+		{"wonderland.lit", false},
+		{"bob@wonderland.lit", false},
+	}
+	for _, test := range tests {
+		iq := &IQ{ID: "1", Type: IQTypeResult, From: test.from}
+		if IQResponse(req, account).Match(iq) != test.match {
+			t.Errorf("from %q: expected match %v", test.from, test.match)
+		}
+	}
+}
+
+func TestFilterModes(t *testing.T) {
+	x := &XMPP{}
+	_, shared := x.AddFilter(StanzaKind("message"))
+	_, copied := x.AddFilterMode(StanzaKind("message"), FilterCopy)
+	_, exclusive := x.AddFilterMode(StanzaType(MessageTypeChat), FilterExclusive)
+
+	received := func(ch chan interface{}) chan bool {
+		result := make(chan bool, 1)
+		go func() {
+			select {
+			case <-ch:
+				result <- true
+			case <-time.After(50 * time.Millisecond):
+				result <- false
+			}
+		}()
+		return result
+	}
+
+	// Exclusive filter consumes the stanza.
+	s, c, e := received(shared), received(copied), received(exclusive)
+	if !x.filter(&Message{Type: MessageTypeChat}) {
+		t.Errorf("exclusive: expected stanza to be filtered")
+	}
+	if <-s || <-c || !<-e {
+		t.Errorf("exclusive: wrong delivery")
+	}
+
+	// Shared and copy filters both get the stanza.
+	s, c, e = received(shared), received(copied), received(exclusive)
+	if !x.filter(&Message{}) {
+		t.Errorf("shared: expected stanza to be filtered")
+	}
+	if !<-s || !<-c || <-e {
+		t.Errorf("shared: wrong delivery")
+	}
+
+	// Copy filters don't stop the stanza going to In.
+	x = &XMPP{}
+	_, copied = x.AddFilterMode(StanzaKind("message"), FilterCopy)
+	c = received(copied)
+	if x.filter(&Message{}) {
+		t.Errorf("copy: expected stanza to not be filtered")
+	}
+	if !<-c {
+		t.Errorf("copy: wrong delivery")
+	}
+}
+
+// Read raw data from the client until the stream's closing tag.
+func (s *testServer) recvEnd(t *testing.T) []byte {
+	var data []byte
+	buf := make([]byte, 1024)
+	for !bytes.Contains(data, []byte("</stream:stream>")) {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			t.Error(err)
+			return data
+		}
+		data = append(data, buf[:n]...)
+	}
+	return data
+}
+
+func TestSend(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go s.recvIQ(t)
+	if err := x.Send(context.Background(), &IQ{ID: "1", Type: IQTypeGet}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	x, s := newTestXMPP(t)
+	_, ch := x.AddFilter(StanzaKind("message"))
+	go func() {
+		s.recvEnd(t)
+		s.send(t, "</stream:stream>")
+	}()
+	go func() {
+		for range x.In {
+		}
+	}()
+
+	start := time.Now()
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) >= x.stream.config.CloseTimeout {
+		t.Errorf("Close did not see the server's closing tag")
+	}
+
+	select {
+	case <-x.Done():
+	default:
+		t.Errorf("Done not closed")
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("filter channel not closed")
+	}
+	if err := x.Send(context.Background(), &Message{}); err != ErrStreamClosed {
+		t.Errorf("expected ErrStreamClosed, got %v", err)
+	}
+	if err := x.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go s.recvEnd(t)
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-x.In; ok {
+		t.Errorf("In not closed")
+	}
+}
+
+func TestInvalidAddressDropped(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go s.send(t, "<message from='@wonderland.lit' id='1'/><message from='hatter@wonderland.lit' id='2'/>")
+	select {
+	case v := <-x.In:
+		if msg, ok := v.(*Message); !ok || msg.ID != "2" {
+			t.Errorf("unexpected stanza: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+
+	// Requests are answered, other IQs are dropped like any other stanza.
+	go s.send(t, "<iq type='result' from='@wonderland.lit' id='3'/><iq type='get' from='@wonderland.lit' id='4'><ping xmlns='urn:xmpp:ping'/></iq>")
+	if resp := s.recvIQ(t); resp.ID != "4" || resp.Type != IQTypeError || resp.Error == nil || !resp.Error.Is(ErrorJIDMalformed) {
+		t.Errorf("expected jid-malformed error, got %v", resp)
+	}
+}
+
+func TestDecodeErrorDropsStanza(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		// The confirm element is decoded into Message.Confirm, which
+		// requires the XEP-0070 namespace.
+		s.send(t, "<message from='hatter@wonderland.lit/tea'><confirm xmlns='urn:example'/><body>Tea?</body></message>")
+		s.send(t, "<message from='hatter@wonderland.lit/tea'><body>More tea?</body></message>")
+	}()
+	select {
+	case v, ok := <-x.In:
+		if msg, _ := v.(*Message); !ok || msg == nil || msg.Body[0].Value != "More tea?" {
+			t.Errorf("expected the next message, got %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestCloseFromInReader(t *testing.T) {
+	x, s := newTestXMPP(t)
+	go func() {
+		s.recvEnd(t)
+		s.send(t, "</stream:stream>")
+	}()
+
+	closed := make(chan time.Duration)
+	go func() {
+		<-x.In
+		start := time.Now()
+		x.Close()
+		closed <- time.Since(start)
+	}()
+	s.send(t, "<message from='hatter@wonderland.lit/tea'/>")
+	if d := <-closed; d >= x.stream.config.CloseTimeout {
+		t.Errorf("Close waited for the CloseTimeout")
+	}
+}